@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const headerFieldPrefix = "header:"
+
+var (
+	logFormat     string
+	logFields     string
+	logFile       string
+	logMaxSize    int
+	logMaxBackups int
+	logMaxAge     int
+
+	// logOutput receives all the access logs written by zerolog as JSON lines
+	logOutput = &LogSink{format: "json", out: os.Stdout}
+	// logHeaders are the request headers (header:Name in -logfields) added to the access logs
+	logHeaders []string
+
+	logFormats = []string{"json", "logfmt", "combined", "alb"}
+)
+
+// LogSink converts the JSON lines written by zerolog to the format of -logformat
+// and writes them to stdout or the rotating file of -logfile
+type LogSink struct {
+	format string
+	fields []string // keys to output in the order (json and logfmt). if empty, all keys
+	out    io.Writer
+}
+
+// initAccessLog configures logOutput with the -log* flags
+func initAccessLog() error {
+	if !slices.Contains(logFormats, logFormat) {
+		return fmt.Errorf("invalid value \"%s\" for flag -logformat: must be %s", logFormat, strings.Join(logFormats, ", "))
+	}
+	for name, value := range map[string]int{
+		"logmaxbackups": logMaxBackups,
+		"logmaxage":     logMaxAge,
+	} {
+		if value < 0 {
+			return fmt.Errorf("invalid value \"%d\" for flag -%s: less than zero", value, name)
+		}
+	}
+	if logMaxSize <= 0 {
+		return fmt.Errorf("invalid value \"%d\" for flag -logmaxsize: zero or less", logMaxSize)
+	}
+	fields := []string{}
+	for _, field := range splitAndTrim(logFields) {
+		if strings.HasPrefix(field, headerFieldPrefix) {
+			name := http.CanonicalHeaderKey(strings.TrimPrefix(field, headerFieldPrefix))
+			if name == "" {
+				return fmt.Errorf("invalid value \"%s\" for flag -logfields: empty header name", logFields)
+			}
+			logHeaders = append(logHeaders, name)
+			field = headerFieldKey(name)
+		}
+		fields = append(fields, field)
+	}
+	logOutput.format = logFormat
+	logOutput.fields = fields
+	if logFile != "" {
+		logOutput.out = &lumberjack.Logger{
+			Filename:   logFile,
+			MaxSize:    logMaxSize,
+			MaxBackups: logMaxBackups,
+			MaxAge:     logMaxAge,
+			LocalTime:  true,
+		}
+	}
+	return nil
+}
+
+// headerFieldKey returns the key of the request header in the access logs (e.g. x-amzn-trace-id)
+func headerFieldKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// getLogHeaders returns the values of logHeaders in the request
+func getLogHeaders(header http.Header) map[string]string {
+	if len(logHeaders) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(logHeaders))
+	for _, name := range logHeaders {
+		values[headerFieldKey(name)] = header.Get(name)
+	}
+	return values
+}
+
+// Write converts p (a JSON line written by zerolog) and writes it
+func (ls *LogSink) Write(p []byte) (int, error) {
+	if ls.format == "json" && len(ls.fields) == 0 {
+		return ls.out.Write(p)
+	}
+	rec, err := parseLogRecord(p)
+	if err != nil {
+		// not a JSON object. write it as it is
+		return ls.out.Write(p)
+	}
+	var line []byte
+	switch ls.format {
+	case "json":
+		line = rec.selectKeys(ls.fields).json()
+	case "logfmt":
+		line = rec.selectKeys(ls.fields).logfmt()
+	case "combined":
+		line = rec.combined()
+	case "alb":
+		line = rec.alb()
+	}
+	if line == nil {
+		return len(p), nil
+	}
+	if _, err := ls.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logRecord ... a log line with the order of the keys
+type logRecord struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func parseLogRecord(p []byte) (*logRecord, error) {
+	dec := json.NewDecoder(bytes.NewReader(p))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	rec := &logRecord{values: map[string]json.RawMessage{}}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if _, ok := rec.values[key]; !ok {
+			rec.keys = append(rec.keys, key)
+		}
+		rec.values[key] = value
+	}
+	return rec, nil
+}
+
+// selectKeys returns the record having only keys in the order. missing keys are skipped.
+func (rec *logRecord) selectKeys(keys []string) *logRecord {
+	if len(keys) == 0 {
+		return rec
+	}
+	selected := &logRecord{values: map[string]json.RawMessage{}}
+	for _, key := range keys {
+		if value, ok := rec.values[key]; ok {
+			selected.keys = append(selected.keys, key)
+			selected.values[key] = value
+		}
+	}
+	return selected
+}
+
+func (rec *logRecord) has(key string) bool {
+	_, ok := rec.values[key]
+	return ok
+}
+
+// str returns the value as a string. JSON strings are unquoted and the others are returned as they are.
+func (rec *logRecord) str(key string) string {
+	value, ok := rec.values[key]
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	return string(value)
+}
+
+// first returns the value of the first key in the record
+func (rec *logRecord) first(keys ...string) string {
+	for _, key := range keys {
+		if rec.has(key) {
+			return rec.str(key)
+		}
+	}
+	return ""
+}
+
+func (rec *logRecord) time(keys ...string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, rec.first(keys...))
+	return t, err == nil
+}
+
+func (rec *logRecord) json() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range rec.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyJSON, _ := json.Marshal(key)
+		buf.Write(keyJSON)
+		buf.WriteByte(':')
+		buf.Write(rec.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+func (rec *logRecord) logfmt() []byte {
+	buf := &bytes.Buffer{}
+	for i, key := range rec.keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(rec.str(key)))
+	}
+	return buf.Bytes()
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// isRequest returns true if the record is the log of a request (http request, grpc unary call or
+// closed grpc stream). the other logs (e.g. websocket messages and grpc stream messages) are not.
+func (rec *logRecord) isRequest() bool {
+	if !rec.has("method") {
+		return false
+	}
+	action := rec.str("action")
+	return action == "" || action == "close"
+}
+
+func (rec *logRecord) isGrpc() bool {
+	return strings.HasPrefix(rec.str("proto"), "grpc")
+}
+
+// requestLine returns "METHOD PATH?QUERY PROTOCOL". the path of grpc is the full method name.
+func (rec *logRecord) requestLine(withURL bool) string {
+	method, path, httpver := rec.str("method"), rec.str("path"), rec.first("httpver")
+	if rec.isGrpc() {
+		method, path, httpver = http.MethodPost, rec.str("method"), "HTTP/2.0"
+	}
+	if qstr := rec.str("qstr"); qstr != "" {
+		// qstr is unescaped. escape the characters breaking the fields of the line
+		path += "?" + strings.NewReplacer(" ", "%20", `"`, "%22").Replace(qstr)
+	}
+	if withURL {
+		scheme := "http"
+		if slices.Contains([]string{"https", "h2", "grpcs"}, rec.str("proto")) {
+			scheme = "https"
+		}
+		host := rec.str("host")
+		if host == "" {
+			host = net.JoinHostPort(rec.str("targetip"), rec.str("targetport"))
+		} else if _, _, err := net.SplitHostPort(host); err != nil {
+			host += ":" + rec.str("targetport")
+		}
+		path = scheme + "://" + host + path
+	}
+	if httpver == "" {
+		httpver = "-"
+	}
+	return method + " " + path + " " + httpver
+}
+
+func (rec *logRecord) status() string {
+	if status := rec.str("status"); status != "" {
+		return status
+	}
+	if rec.isGrpc() {
+		// grpc responses are 200 OK. the status of the call is the code field.
+		return "200"
+	}
+	return "-"
+}
+
+// duration returns the seconds between the request and the response
+func (rec *logRecord) duration() float64 {
+	reqtime, ok1 := rec.time("reqtime", "recvtime", "opentime")
+	restime, ok2 := rec.time("time", "sendtime", "closetime")
+	if ok1 && ok2 {
+		return restime.Sub(reqtime).Seconds()
+	}
+	ms, _ := strconv.ParseFloat(rec.str("duration"), 64)
+	return ms / 1000
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quoteLogValue(s string) string {
+	return `"` + strings.ReplaceAll(dashIfEmpty(s), `"`, `\"`) + `"`
+}
+
+// combined returns the Apache combined log format line of the request
+func (rec *logRecord) combined() []byte {
+	if !rec.isRequest() {
+		return nil
+	}
+	reqtime, ok := rec.time("reqtime", "recvtime", "opentime")
+	if !ok {
+		reqtime = time.Now()
+	}
+	size := rec.str("size")
+	if size == "" || size == "0" {
+		size = "-"
+	}
+	return []byte(strings.Join([]string{
+		dashIfEmpty(rec.first("clientip", "srcip")),
+		"-",
+		"-",
+		reqtime.Format("[02/Jan/2006:15:04:05 -0700]"),
+		quoteLogValue(rec.requestLine(false)),
+		rec.status(),
+		size,
+		quoteLogValue(rec.str("referer")),
+		quoteLogValue(rec.str("useragent")),
+	}, " "))
+}
+
+// albType returns the type field of ALB access logs
+func (rec *logRecord) albType() string {
+	switch rec.str("proto") {
+	case "https":
+		return "https"
+	case "h2":
+		return "h2"
+	case "grpc", "grpcs":
+		return "grpcs"
+	default:
+		return "http"
+	}
+}
+
+// alb returns the line in the layout of ALB access logs. the fields gelbo cannot know (e.g. elb and
+// target_group_arn) are "-", and the request processing time is the target processing time.
+func (rec *logRecord) alb() []byte {
+	if !rec.isRequest() {
+		return nil
+	}
+	const albTimeFormat = "2006-01-02T15:04:05.000000Z"
+	reqtime, ok := rec.time("reqtime", "recvtime", "opentime")
+	if !ok {
+		reqtime = time.Now()
+	}
+	restime, ok := rec.time("time", "sendtime", "closetime")
+	if !ok {
+		restime = time.Now()
+	}
+	// the port of the client is known only when the request does not pass through proxies
+	client := rec.first("clientip", "srcip") + ":"
+	if rec.str("clientip") == rec.str("srcip") {
+		client += rec.str("srcport")
+	}
+	target := rec.str("targetip") + ":" + rec.str("targetport")
+	status := rec.status()
+	return []byte(strings.Join([]string{
+		rec.albType(),
+		restime.UTC().Format(albTimeFormat),
+		"-",
+		client,
+		target,
+		"0.000",
+		fmt.Sprintf("%.3f", rec.duration()),
+		"0.000",
+		status,
+		status,
+		dashIfEmpty(rec.first("reqsize")),
+		dashIfEmpty(rec.first("size")),
+		quoteLogValue(rec.requestLine(true)),
+		quoteLogValue(rec.str("useragent")),
+		"-",
+		"-",
+		"-",
+		quoteLogValue(rec.str("traceid")),
+		quoteLogValue(""),
+		quoteLogValue(""),
+		"-",
+		reqtime.UTC().Format(albTimeFormat),
+		quoteLogValue("forward"),
+		quoteLogValue(""),
+		quoteLogValue(""),
+		quoteLogValue(target),
+		quoteLogValue(status),
+		quoteLogValue(""),
+		quoteLogValue(""),
+		"-",
+	}, " "))
+}
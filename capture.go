@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	captureFile    string
+	captureMaxBody int64
+	captureWriter  *CaptureWriter
+)
+
+// CapturedRequest ... a request recorded by -capture (a line of the JSONL file)
+type CapturedRequest struct {
+	Time     int64               `json:"time"` // received time (unix nano)
+	Proto    string              `json:"proto"`
+	Method   string              `json:"method"`
+	Host     string              `json:"host"`
+	Path     string              `json:"path"`
+	Query    string              `json:"query,omitempty"` // raw query
+	Headers  map[string][]string `json:"headers"`
+	Body     []byte              `json:"body,omitempty"`     // base64. truncated at -capturemaxbody
+	BodySize int64               `json:"body_size"`          // size of the whole body
+	Status   int                 `json:"status"`             // status gelbo responded
+	Duration float64             `json:"duration"`           // millisecond
+	Timing   *RecordTiming       `json:"timing,omitempty"`   // millisecond
+	ClientIP string              `json:"clientip,omitempty"` // client IP address (X-Forwarded-For)
+}
+
+// CaptureWriter ... writes CapturedRequest to the file with exclusive control
+type CaptureWriter struct {
+	*sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// initCapture opens -capture file (appended if it exists)
+func initCapture() error {
+	if captureFile == "" {
+		return nil
+	}
+	file, err := os.OpenFile(captureFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetEscapeHTML(false)
+	captureWriter = &CaptureWriter{Mutex: &sync.Mutex{}, file: file, encoder: encoder}
+	return nil
+}
+
+func captureEnabled() bool {
+	return captureWriter != nil
+}
+
+func (cw *CaptureWriter) write(req *CapturedRequest) {
+	cw.Lock()
+	defer cw.Unlock()
+	if err := cw.encoder.Encode(req); err != nil {
+		fmt.Fprintf(os.Stderr, "capture error: %v\n", err)
+	}
+}
+
+// readBodyForCapture reads the body keeping up to -capturemaxbody bytes and returns them with the whole size
+func readBodyForCapture(body io.Reader) ([]byte, int64) {
+	buf := &bytes.Buffer{}
+	kept, _ := io.Copy(buf, io.LimitReader(body, captureMaxBody))
+	rest, _ := io.Copy(io.Discard, body)
+	return buf.Bytes(), kept + rest
+}
+
+// capture writes the HTTP request to -capture file
+func (l *HttpLogger) capture(restime time.Time) {
+	if !captureEnabled() {
+		return
+	}
+	captureWriter.write(&CapturedRequest{
+		Time:     l.reqtime.UnixNano(),
+		Proto:    l.proto,
+		Method:   l.method,
+		Host:     l.host,
+		Path:     l.path,
+		Query:    l.rawquery,
+		Headers:  l.header,
+		Body:     l.body,
+		BodySize: l.reqsize,
+		Status:   l.status,
+		Duration: durationMillis(restime.Sub(l.reqtime)),
+		Timing: &RecordTiming{
+			TLS:    durationMillis(l.timing.tls),
+			Header: durationMillis(l.timing.header),
+			Body:   durationMillis(l.timing.body),
+			Action: durationMillis(l.timing.action),
+			Write:  durationMillis(l.timing.write),
+		},
+		ClientIP: l.clientip,
+	})
+}
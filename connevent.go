@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/peer"
+)
+
+// close initiators of connection close events
+const (
+	initiatorClient      = "client"
+	initiatorIdleTimeout = "idle_timeout"
+	initiatorDisconnect  = "disconnect"
+	initiatorShutdown    = "shutdown"
+	initiatorGoAway      = "server_goaway"
+	initiatorServer      = "server"
+)
+
+// idleTimeoutMargin is the tolerance for judging the close of an idle connection as the idle timeout
+const idleTimeoutMargin = 100 * time.Millisecond
+
+var (
+	connLogFlag  bool
+	shuttingDown atomic.Bool
+)
+
+// connEvent returns the event of the connection lifecycle log with the common fields.
+// it returns nil (all methods are no-op) if -connlog is disabled.
+func (cs *ConnState) connEvent(action string) *zerolog.Event {
+	if !connLogFlag {
+		return nil
+	}
+	cs.mu.RLock()
+	accepttime, proto := cs.accepttime, cs.proto
+	cs.mu.RUnlock()
+	remoteAddr := cs.conn.RemoteAddr().String()
+	localAddr := cs.conn.LocalAddr().String()
+	logger := zerolog.New(logOutput).With().
+		Time("conntime", accepttime).
+		Str("proto", proto).
+		Str("srcip", extractIPAddress(remoteAddr)).
+		Int("srcport", extractPort(remoteAddr)).
+		Str("targetip", extractIPAddress(localAddr)).
+		Int("targetport", extractPort(localAddr)).
+		Logger()
+	return logger.Log().
+		Str("action", "conn_"+action).
+		Time("time", time.Now()).
+		Dur("connage", time.Since(accepttime)).
+		Int64("requests", atomic.LoadInt64(&cs.reuse)+1)
+}
+
+func (cs *ConnState) setProto(proto string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.proto = proto
+}
+
+// closeInitiator judges who closed the http connection from the state before the close
+func (cs *ConnState) closeInitiator() string {
+	if shuttingDown.Load() {
+		return initiatorShutdown
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cs.prevState == http.StateIdle && idleTimeout > 0 &&
+		time.Since(cs.readytime) >= time.Duration(idleTimeout)*time.Second-idleTimeoutMargin {
+		return initiatorIdleTimeout
+	}
+	return initiatorClient
+}
+
+// logHttpConnEvent logs the state change of the http connection
+func (cs *ConnState) logHttpConnEvent(state http.ConnState) {
+	switch state {
+	case http.StateActive:
+		cs.mu.RLock()
+		first := cs.prevState == http.StateNew
+		cs.mu.RUnlock()
+		if first {
+			cs.connEvent("first_request").Msg("")
+		}
+	case http.StateIdle:
+		cs.connEvent("idle").Msg("")
+	case http.StateHijacked:
+		cs.connEvent("hijack").Msg("")
+	case http.StateClosed:
+		cs.connEvent("close").Str("initiator", cs.closeInitiator()).Msg("")
+	}
+}
+
+// getConnStateFromContext returns the ConnState of the grpc connection
+func getConnStateFromContext(ctx context.Context) (*ConnState, bool) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	return csMaps.get(connKey(pr.Addr.String(), pr.LocalAddr.String()))
+}
+
+// countGrpcRequest counts the rpc as a request of the connection (reuse). first_request is logged
+// before counting, the same as http (logged when the connection becomes active).
+func countGrpcRequest(ctx context.Context) {
+	cs, ok := getConnStateFromContext(ctx)
+	if !ok {
+		return
+	}
+	if cs.firstRequest.CompareAndSwap(false, true) {
+		cs.connEvent("first_request").Msg("")
+	}
+	atomic.AddInt64(&cs.reuse, 1)
+}
+
+// grpcConnState returns the ConnState of the grpc connection by its addresses
+func grpcConnState(conn net.Conn) (*ConnState, bool) {
+	return csMaps.get(connKey(conn.RemoteAddr().String(), conn.LocalAddr().String()))
+}
+
+// closeInitiator judges who closed the grpc connection
+func (c *grpcTrackedConn) closeInitiator() string {
+	switch {
+	case shuttingDown.Load():
+		return initiatorShutdown
+	case c.goAwaySent.Load():
+		return initiatorGoAway
+	case c.readFailed.Load():
+		return initiatorClient
+	default:
+		return initiatorServer
+	}
+}
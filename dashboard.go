@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	dashboardInterval = time.Second
+	dashboardMaxLogs  = 100
+)
+
+var (
+	recentLogs = NewLogBuffer(dashboardMaxLogs)
+	// accessLogWriter writes the access logs to logOutput and keeps the recent lines for the dashboard
+	accessLogWriter io.Writer = io.MultiWriter(logOutput, recentLogs)
+)
+
+// LogBuffer ... the recent log lines with exclusive control
+type LogBuffer struct {
+	*sync.Mutex
+	lines [][]byte
+	size  int
+	seq   int64 // sequence number of the last line
+}
+
+// NewLogBuffer ... create LogBuffer instance
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{Mutex: &sync.Mutex{}, size: size}
+}
+
+// Write keeps a copy of p (a line written by zerolog)
+func (lb *LogBuffer) Write(p []byte) (int, error) {
+	lb.Lock()
+	defer lb.Unlock()
+	line := make([]byte, len(p))
+	copy(line, p)
+	lb.lines = append(lb.lines, line)
+	if len(lb.lines) > lb.size {
+		lb.lines = lb.lines[len(lb.lines)-lb.size:]
+	}
+	lb.seq++
+	return len(p), nil
+}
+
+// since returns the lines after seq and the sequence number of the last line
+func (lb *LogBuffer) since(seq int64) ([]json.RawMessage, int64) {
+	lb.Lock()
+	defer lb.Unlock()
+	n := int(lb.seq - seq)
+	if n > len(lb.lines) {
+		n = len(lb.lines)
+	}
+	lines := []json.RawMessage{}
+	for _, line := range lb.lines[len(lb.lines)-n:] {
+		if json.Valid(line) {
+			lines = append(lines, json.RawMessage(line))
+		}
+	}
+	return lines, lb.seq
+}
+
+// DashboardData ... data pushed to the dashboard every second
+type DashboardData struct {
+	Time     int64                    `json:"time"`
+	Host     HostInfo                 `json:"host"`
+	Resource ResourceInfo             `json:"resource"`
+	Node     DashboardNode            `json:"node"`
+	ELBs     map[string]DashboardNode `json:"elbs"`
+	Logs     []json.RawMessage        `json:"logs"`
+}
+
+// DashboardNode ... statistics of the node or an ELB node with its request rates
+type DashboardNode struct {
+	RequestCount  int64       `json:"request_count"`
+	SentBytes     int64       `json:"sent_bytes"`
+	ReceivedBytes int64       `json:"received_bytes"`
+	ActiveConns   int64       `json:"active_conns"`
+	TotalConns    int64       `json:"total_conns"`
+	RPS           []RPSWindow `json:"rps"`
+}
+
+func newDashboardNode(name string, node *NodeInfo) DashboardNode {
+	node.RLock()
+	dn := DashboardNode{
+		RequestCount:  node.RequestCount,
+		SentBytes:     node.SentBytes,
+		ReceivedBytes: node.ReceivedBytes,
+		ActiveConns:   node.ActiveConns,
+		TotalConns:    node.TotalConns,
+		RPS:           []RPSWindow{},
+	}
+	node.RUnlock()
+	if nh := history.get(name, "second", 1); nh != nil {
+		dn.RPS = nh.RPS
+	}
+	return dn
+}
+
+func newDashboardData(logs []json.RawMessage) *DashboardData {
+	updateNode()
+	data := &DashboardData{
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+		Host: *store.getHostInfo(),
+		Resource: ResourceInfo{
+			CPU: ResourceUsage{
+				Target:  store.resource.CPU.getTarget(),
+				Current: store.resource.CPU.getCurrent(),
+			},
+			Memory: ResourceUsage{
+				Target:  store.resource.Memory.getTarget(),
+				Current: store.resource.Memory.getCurrent(),
+			},
+		},
+		Node: newDashboardNode(historyNodeName, store.node),
+		ELBs: map[string]DashboardNode{},
+		Logs: logs,
+	}
+	store.node.RLock()
+	elbs := make(map[string]*NodeInfo, len(store.node.ELBs))
+	for ip, node := range store.node.ELBs {
+		elbs[ip] = node
+	}
+	store.node.RUnlock()
+	for ip, node := range elbs {
+		data.ELBs[ip] = newDashboardNode(ip, node)
+	}
+	return data
+}
+
+// dashboardWsHandler pushes DashboardData every second. It is not counted in the websocket statistics.
+func dashboardWsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := wsLogger(r)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Log().Str("error", fmt.Sprintf("upgrader.Upgrade error: %v", err)).Msg("")
+		return
+	}
+	defer conn.Close()
+	logger.Log().Msg("dashboard connected")
+
+	// read to process close frames. the dashboard sends nothing.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the dashboard shows the recent lines at first
+	var seq int64
+	t := time.NewTicker(dashboardInterval)
+	defer t.Stop()
+	for {
+		var logs []json.RawMessage
+		logs, seq = recentLogs.since(seq)
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteJSON(newDashboardData(logs)); err != nil {
+			logger.Log().Str("error", err.Error()).Msg("dashboard disconnected")
+			return
+		}
+		select {
+		case <-closed:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			logger.Log().Msg("dashboard disconnected")
+			return
+		case <-t.C:
+		}
+	}
+}
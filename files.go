@@ -12,6 +12,9 @@ var (
 	//go:embed websocket.html
 	chatHTML string
 
+	//go:embed dashboard.html
+	dashboardHTML string
+
 	//go:embed grpc/proto/gelbo.proto
 	gelboProto string
 )
@@ -24,6 +27,7 @@ type File struct {
 func filesDLHandler(w http.ResponseWriter, r *http.Request) {
 	filesMap := map[string]File{}
 	filesMap["/chat/"] = File{Type: "text/html; charset=utf-8", Content: chatHTML}
+	filesMap["/dashboard/"] = File{Type: "text/html; charset=utf-8", Content: dashboardHTML}
 	filesMap["/files/gelbo.proto"] = File{Type: "application/proto; charset=utf-8", Content: gelboProto}
 
 	file, ok := filesMap[r.URL.Path]
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	fleetNodePath     = "/fleet/node"
+	fleetFetchTimeout = 3 * time.Second
+	fleetMaxBodySize  = 1024 * 1024
+)
+
+var (
+	fleetPeers       string
+	fleetPeerDNS     string
+	fleetPeerTag     string
+	fleetPeerPort    int
+	fleetEC2Endpoint string
+
+	fleetClient = &http.Client{Timeout: fleetFetchTimeout}
+)
+
+// PeerDiscoverer finds the base URLs (scheme://host:port) of the other gelbo instances
+type PeerDiscoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// peerURL adds http:// and the default port to host if omitted
+func peerURL(host string, defaultPort int) string {
+	if strings.Contains(host, "://") {
+		return strings.TrimSuffix(host, "/")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(defaultPort))
+	}
+	return "http://" + host
+}
+
+// staticPeers ... -peers
+type staticPeers struct {
+	peers []string
+}
+
+func (d *staticPeers) Discover(ctx context.Context) ([]string, error) {
+	urls := []string{}
+	for _, peer := range d.peers {
+		urls = append(urls, peerURL(peer, fleetPeerPort))
+	}
+	return urls, nil
+}
+
+// dnsPeers ... -peerdns. every address of the name is a peer.
+type dnsPeers struct {
+	name string
+	port int
+}
+
+func newDNSPeers(name string, defaultPort int) *dnsPeers {
+	d := &dnsPeers{name: name, port: defaultPort}
+	if host, port, err := net.SplitHostPort(name); err == nil {
+		d.name = host
+		d.port, _ = strconv.Atoi(port)
+	}
+	return d
+}
+
+func (d *dnsPeers) Discover(ctx context.Context) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	for _, addr := range addrs {
+		urls = append(urls, peerURL(net.JoinHostPort(addr, strconv.Itoa(d.port)), d.port))
+	}
+	return urls, nil
+}
+
+// ec2TagPeers ... -peertag. the running instances with the tag are peers.
+// api can be replaced with a mock, and -peerec2endpoint points the client to a mock server.
+type ec2TagPeers struct {
+	key, value string
+	port       int
+	api        ec2.DescribeInstancesAPIClient
+}
+
+func newEC2TagPeers(tag string, port int) (*ec2TagPeers, error) {
+	key, value, ok := strings.Cut(tag, "=")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("invalid tag (must be key=value): %s", tag)
+	}
+	return &ec2TagPeers{key: key, value: value, port: port}, nil
+}
+
+func (d *ec2TagPeers) client(ctx context.Context) (ec2.DescribeInstancesAPIClient, error) {
+	if d.api != nil {
+		return d.api, nil
+	}
+	opts := []func(*config.LoadOptions) error{}
+	if runOnEC2 {
+		opts = append(opts, config.WithRegion(getEC2MetaData("region")))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	d.api = ec2.NewFromConfig(cfg, func(o *ec2.Options) {
+		if fleetEC2Endpoint != "" {
+			o.BaseEndpoint = aws.String(fleetEC2Endpoint)
+		}
+	})
+	return d.api, nil
+}
+
+func (d *ec2TagPeers) Discover(ctx context.Context) ([]string, error) {
+	api, err := d.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	input := &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("tag:" + d.key), Values: []string{d.value}},
+			{Name: aws.String("instance-state-name"), Values: []string{"running"}},
+		},
+	}
+	urls := []string{}
+	paginator := ec2.NewDescribeInstancesPaginator(api, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if ip := aws.ToString(instance.PrivateIpAddress); ip != "" {
+					urls = append(urls, peerURL(net.JoinHostPort(ip, strconv.Itoa(d.port)), d.port))
+				}
+			}
+		}
+	}
+	return urls, nil
+}
+
+var (
+	peerDiscoverers []PeerDiscoverer
+	peerDiscoverMu  = &sync.Mutex{}
+)
+
+// initPeerDiscoverers sets up the discoverers specified by -peers, -peerdns and -peertag
+func initPeerDiscoverers() error {
+	if fleetPeers != "" {
+		peerDiscoverers = append(peerDiscoverers, &staticPeers{peers: splitAndTrim(fleetPeers)})
+	}
+	if fleetPeerDNS != "" {
+		peerDiscoverers = append(peerDiscoverers, newDNSPeers(fleetPeerDNS, fleetPeerPort))
+	}
+	if fleetPeerTag != "" {
+		d, err := newEC2TagPeers(fleetPeerTag, fleetPeerPort)
+		if err != nil {
+			return err
+		}
+		peerDiscoverers = append(peerDiscoverers, d)
+	}
+	return nil
+}
+
+// discoverPeers returns the peer URLs without duplicates and the errors of the discoverers
+func discoverPeers(ctx context.Context) ([]string, []string) {
+	peerDiscoverMu.Lock()
+	defer peerDiscoverMu.Unlock()
+	seen := map[string]bool{}
+	peers, errs := []string{}, []string{}
+	for _, d := range peerDiscoverers {
+		urls, err := d.Discover(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, url := range urls {
+			if !seen[url] {
+				seen[url] = true
+				peers = append(peers, url)
+			}
+		}
+	}
+	sort.Strings(peers)
+	return peers, errs
+}
+
+// FleetNode ... statistics of a gelbo instance (response of /fleet/node)
+type FleetNode struct {
+	ID            string                  `json:"id"` // instance id to skip this instance in the peers
+	Host          HostInfo                `json:"host"`
+	RequestCount  int64                   `json:"request_count"`
+	SentBytes     int64                   `json:"sent_bytes"`
+	ReceivedBytes int64                   `json:"received_bytes"`
+	ActiveConns   int64                   `json:"active_conns"`
+	TotalConns    int64                   `json:"total_conns"`
+	CPU           float64                 `json:"cpu"`
+	Memory        float64                 `json:"memory"`
+	ELBs          map[string]NodeCounters `json:"elbs"`
+}
+
+// FleetTarget ... statistics of a gelbo instance with its share of the fleet requests
+type FleetTarget struct {
+	Peer  string     `json:"peer"` // "self" for this instance
+	Error string     `json:"error,omitempty"`
+	Share float64    `json:"share"` // percentage of the requests of the fleet
+	Node  *FleetNode `json:"node,omitempty"`
+}
+
+// FleetELB ... requests passed through an ELB node across the fleet
+type FleetELB struct {
+	RequestCount int64            `json:"request_count"`
+	Share        float64          `json:"share"`   // percentage of the requests through all ELB nodes
+	Targets      map[string]int64 `json:"targets"` // request count per target IP
+}
+
+// FleetResult ... response of /fleet/
+type FleetResult struct {
+	Peers   []string             `json:"peers"`
+	Errors  []string             `json:"errors,omitempty"`
+	Total   NodeCounters         `json:"total"`
+	Targets []*FleetTarget       `json:"targets"`
+	ELBs    map[string]*FleetELB `json:"elbs"`
+}
+
+func getFleetNode() *FleetNode {
+	updateNode()
+	store.node.RLock()
+	node := &FleetNode{
+		ID:            instanceID,
+		Host:          *store.getHostInfo(),
+		RequestCount:  store.node.RequestCount,
+		SentBytes:     store.node.SentBytes,
+		ReceivedBytes: store.node.ReceivedBytes,
+		ActiveConns:   store.node.ActiveConns,
+		TotalConns:    store.node.TotalConns,
+		CPU:           store.node.CPU,
+		Memory:        store.node.Memory,
+		ELBs:          map[string]NodeCounters{},
+	}
+	elbs := make(map[string]*NodeInfo, len(store.node.ELBs))
+	for ip, elb := range store.node.ELBs {
+		elbs[ip] = elb
+	}
+	store.node.RUnlock()
+	for ip, elb := range elbs {
+		node.ELBs[ip] = elb.getCounters()
+	}
+	return node
+}
+
+func fetchFleetNode(ctx context.Context, peer string) (*FleetNode, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+fleetNodePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fleetClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, fleetMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	node := &FleetNode{}
+	if err := json.Unmarshal(body, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func percentage(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(part)/float64(total)*1000) / 10
+}
+
+// aggregateFleet fetches the statistics of all peers and merges them with this instance.
+// Peers answering with the id of this instance (e.g. itself in the DNS name) or a duplicate id are skipped.
+func aggregateFleet(ctx context.Context) *FleetResult {
+	peers, errs := discoverPeers(ctx)
+	result := &FleetResult{Peers: peers, Errors: errs, Targets: []*FleetTarget{}, ELBs: map[string]*FleetELB{}}
+	self := getFleetNode()
+	targets := make([]*FleetTarget, len(peers))
+	wg := &sync.WaitGroup{}
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			target := &FleetTarget{Peer: peer}
+			if node, err := fetchFleetNode(ctx, peer); err != nil {
+				target.Error = err.Error()
+			} else {
+				target.Node = node
+			}
+			targets[i] = target
+		}(i, peer)
+	}
+	wg.Wait()
+
+	result.Targets = append(result.Targets, &FleetTarget{Peer: "self", Node: self})
+	seen := map[string]bool{self.ID: true}
+	for _, target := range targets {
+		if target.Node != nil {
+			if seen[target.Node.ID] {
+				continue
+			}
+			seen[target.Node.ID] = true
+		}
+		result.Targets = append(result.Targets, target)
+	}
+
+	var elbTotal int64
+	for _, target := range result.Targets {
+		if target.Node == nil {
+			continue
+		}
+		result.Total.RequestCount += target.Node.RequestCount
+		result.Total.SentBytes += target.Node.SentBytes
+		result.Total.ReceivedBytes += target.Node.ReceivedBytes
+		for ip, counters := range target.Node.ELBs {
+			elb, ok := result.ELBs[ip]
+			if !ok {
+				elb = &FleetELB{Targets: map[string]int64{}}
+				result.ELBs[ip] = elb
+			}
+			elb.RequestCount += counters.RequestCount
+			elb.Targets[target.Node.Host.IP] += counters.RequestCount
+			elbTotal += counters.RequestCount
+		}
+	}
+	for _, target := range result.Targets {
+		if target.Node != nil {
+			target.Share = percentage(target.Node.RequestCount, result.Total.RequestCount)
+		}
+	}
+	for _, elb := range result.ELBs {
+		elb.Share = percentage(elb.RequestCount, elbTotal)
+	}
+	return result
+}
+
+// fleetHandler serves /fleet/ (aggregated statistics), /fleet/node (statistics of this instance for peers)
+// and /fleet/peers (discovered peers), /fleet/directive (directives for all instances) and /fleet/apply
+func fleetHandler(w http.ResponseWriter, r *http.Request) {
+	rawFlag := r.URL.Query().Has("raw")
+	switch r.URL.Path {
+	case fleetNodePath:
+		respJSON, _ := json.Marshal(getFleetNode())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respJSON)
+	case "/fleet/peers":
+		peers, errs := discoverPeers(r.Context())
+		writeMonitorJSON(w, map[string][]string{"peers": peers, "errors": errs}, rawFlag)
+	case "/fleet/directive":
+		fleetDirectiveHandler(w, r)
+	case fleetApplyPath:
+		fleetApplyHandler(w, r)
+	case "/fleet/":
+		writeMonitorJSON(w, aggregateFleet(r.Context()), rawFlag)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const fleetApplyPath = "/fleet/apply"
+
+// fleetDirectives are the directives that change the state of the instances (not a single response)
+var fleetDirectives = []string{
+	"cpu", "memory", "addheader", "delheader",
+	"grpcping", "grpcpingtimeout", "grpcmaxidle", "grpcmaxage", "grpcmaxagegrace",
+	"grpcminpingtime", "grpcmaxstreams", "grpcwindow", "grpcconnwindow",
+}
+
+// fleetConditions are the if* conditions about the instance. conditions about the client
+// (ifclientip, ifproxy*ip, iflasthopip) are meaningless since the request comes from the coordinator.
+var fleetConditions = []string{"ifhost", "ifhostip", "iftargetip", "ifaz", "iftype"}
+
+// FleetApplyResult ... result of the directives on an instance (response of /fleet/apply)
+type FleetApplyResult struct {
+	ID        string       `json:"id"`
+	Host      HostInfo     `json:"host"`
+	Applied   bool         `json:"applied"`
+	Resource  ResourceInfo `json:"resource"`
+	Direction Direction    `json:"direction"`
+}
+
+// FleetDirectiveTarget ... per-peer result of /fleet/directive
+type FleetDirectiveTarget struct {
+	Peer   string            `json:"peer"` // "self" for this instance
+	Error  string            `json:"error,omitempty"`
+	Result *FleetApplyResult `json:"result,omitempty"`
+}
+
+// FleetDirectiveResult ... response of /fleet/directive
+type FleetDirectiveResult struct {
+	Peers   []string                `json:"peers"`
+	Errors  []string                `json:"errors,omitempty"`
+	Applied int                     `json:"applied"` // number of the targets the directives were applied to
+	Targets []*FleetDirectiveTarget `json:"targets"`
+}
+
+// checkFleetQuery returns an error if the query has parameters other than fleetDirectives and fleetConditions
+func checkFleetQuery(qsMap url.Values) error {
+	unsupported := []string{}
+	for key := range qsMap {
+		if !slices.Contains(fleetDirectives, key) && !slices.Contains(fleetConditions, key) {
+			unsupported = append(unsupported, key)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("unsupported parameters: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// applyFleetDirectives evaluates the directives with the if* conditions of this instance and applies them
+func applyFleetDirectives(r *http.Request) *FleetApplyResult {
+	reqInfo := newRequestInfo(r)
+	inputCmds := reqInfo.validateCommands(r.URL.Query())
+	resultCmds := inputCmds.evaluate()
+	result := &FleetApplyResult{ID: instanceID, Host: *store.getHostInfo(), Direction: Direction{Input: inputCmds, Result: resultCmds}}
+	if inputCmds.needsAction() {
+		result.Applied = true
+		if arrayContains(inputCmds.actions, "cpu") {
+			cpu, _ := strconv.ParseFloat(resultCmds.getValue("cpu"), 64)
+			store.resource.CPU.setTarget(cpu)
+		}
+		if arrayContains(inputCmds.actions, "memory") {
+			memory, _ := strconv.ParseFloat(resultCmds.getValue("memory"), 64)
+			store.resource.Memory.setTarget(memory)
+		}
+		applyGrpcParamDirectives(inputCmds, resultCmds)
+		if arrayContains(inputCmds.actions, "addheader") {
+			addHeader := strings.SplitN(resultCmds.getValue("addheader"), ":", 2)
+			headerMap.add(addHeader[0], addHeader[1])
+		}
+		if arrayContains(inputCmds.actions, "delheader") {
+			headerMap.del(resultCmds.getValue("delheader"))
+		}
+	}
+	result.Resource = ResourceInfo{
+		CPU: ResourceUsage{
+			Target:  store.resource.CPU.getTarget(),
+			Current: store.resource.CPU.getCurrent(),
+		},
+		Memory: ResourceUsage{
+			Target:  store.resource.Memory.getTarget(),
+			Current: store.resource.Memory.getCurrent(),
+		},
+	}
+	return result
+}
+
+func postFleetApply(ctx context.Context, peer, rawQuery string) (*FleetApplyResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+fleetApplyPath+"?"+rawQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fleetClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, fleetMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	result := &FleetApplyResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// fleetDirectiveHandler serves /fleet/directive. The directives are applied to this instance and forwarded
+// to all peers, and each instance applies them only if its if* conditions match.
+func fleetDirectiveHandler(w http.ResponseWriter, r *http.Request) {
+	qsMap := r.URL.Query()
+	rawFlag := qsMap.Has("raw")
+	qsMap.Del("raw")
+	if err := checkFleetQuery(qsMap); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rawQuery := qsMap.Encode()
+	r.URL.RawQuery = rawQuery
+
+	peers, errs := discoverPeers(r.Context())
+	result := &FleetDirectiveResult{Peers: peers, Errors: errs, Targets: []*FleetDirectiveTarget{}}
+	self := applyFleetDirectives(r)
+	targets := make([]*FleetDirectiveTarget, len(peers))
+	wg := &sync.WaitGroup{}
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			target := &FleetDirectiveTarget{Peer: peer}
+			if applyResult, err := postFleetApply(r.Context(), peer, rawQuery); err != nil {
+				target.Error = err.Error()
+			} else {
+				target.Result = applyResult
+			}
+			targets[i] = target
+		}(i, peer)
+	}
+	wg.Wait()
+
+	result.Targets = append(result.Targets, &FleetDirectiveTarget{Peer: "self", Result: self})
+	seen := map[string]bool{self.ID: true}
+	for _, target := range targets {
+		if target.Result != nil {
+			if seen[target.Result.ID] {
+				continue
+			}
+			seen[target.Result.ID] = true
+		}
+		result.Targets = append(result.Targets, target)
+	}
+	for _, target := range result.Targets {
+		if target.Result != nil && target.Result.Applied {
+			result.Applied++
+		}
+	}
+	writeMonitorJSON(w, result, rawFlag)
+}
+
+// fleetApplyHandler applies the directives forwarded by /fleet/directive of another instance
+func fleetApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkFleetQuery(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	respJSON, _ := json.Marshal(applyFleetDirectives(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respJSON)
+}
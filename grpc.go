@@ -8,7 +8,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"os"
@@ -24,8 +23,6 @@ import (
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
@@ -65,10 +62,24 @@ type grpcTrackedConn struct {
 	net.Conn
 	remoteAddr string
 	once       sync.Once
+	cs         *ConnState
+	readFailed atomic.Bool // the client closed the connection (or it was broken)
+	goAwaySent atomic.Bool
+}
+
+func (c *grpcTrackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.readFailed.Store(true)
+	}
+	return n, err
 }
 
 func (c *grpcTrackedConn) Close() error {
 	c.once.Do(func() {
+		if c.cs != nil {
+			c.cs.connEvent("close").Str("initiator", c.closeInitiator()).Msg("")
+		}
 		atomic.AddInt64(&cw.total, -1)
 		remoteNodes.addTotalConns(extractIPAddress(c.remoteAddr), -1)
 	})
@@ -97,73 +108,43 @@ func (l *grpcConnListener) Accept() (net.Conn, error) {
 	}
 	tracked := &grpcTrackedConn{Conn: conn, remoteAddr: remoteAddr}
 	csMaps.set(key, tracked)
+	if cs, ok := csMaps.get(key); ok {
+		proto := "grpc"
+		if extractPort(conn.LocalAddr().String()) == grpcsPort {
+			proto = "grpcs"
+		}
+		cs.setProto(proto)
+		tracked.cs = cs
+		cs.connEvent("accept").Msg("")
+	}
 	atomic.AddInt64(&cw.total, 1)
 	remoteNodes.addTotalConns(extractIPAddress(remoteAddr), 1)
 	return tracked, nil
 }
 
 func startGrpcServer() {
-	kaep := keepalive.EnforcementPolicy{
-		PermitWithoutStream: true,
-	}
-	kasp := keepalive.ServerParameters{
-		Time: time.Duration(grpcInterval) * time.Second,
-	}
-	gelboSrv1 := newGelboServer()
-	grpcSrv = grpc.NewServer(
-		grpc.MaxSendMsgSize(grpcMaxSendMsgSize),
-		grpc.MaxRecvMsgSize(grpcMaxRecvMsgSize),
-		grpc.KeepaliveEnforcementPolicy(kaep),
-		grpc.KeepaliveParams(kasp),
-		grpc.UnaryInterceptor(gelboSrv1.UnaryInterceptor()),
-		grpc.StreamInterceptor(gelboSrv1.StreamInterceptor()),
-		grpc.UnknownServiceHandler(gelboSrv1.UnregisteredMethodHandler),
-	)
-	gelboSrv2 := newGelboServer()
-	grpcsSrv = grpc.NewServer(
-		grpc.MaxSendMsgSize(grpcMaxSendMsgSize),
-		grpc.MaxRecvMsgSize(grpcMaxRecvMsgSize),
-		grpc.KeepaliveEnforcementPolicy(kaep),
-		grpc.KeepaliveParams(kasp),
-		grpc.Creds(credentials.NewTLS(loadTLSConfig())),
-		grpc.UnaryInterceptor(gelboSrv2.UnaryInterceptor()),
-		grpc.StreamInterceptor(gelboSrv2.StreamInterceptor()),
-		grpc.UnknownServiceHandler(gelboSrv2.UnregisteredMethodHandler),
-	)
-
-	pb.RegisterGelboServiceServer(grpcSrv, gelboSrv1)
-	pb.RegisterGelboServiceServer(grpcsSrv, gelboSrv2)
+	grpcParamsMu.Lock()
+	defer grpcParamsMu.Unlock()
+	curGrpcParams = getGrpcParamsFromFlags()
+	grpcSrv, grpcsSrv = newGrpcServers(curGrpcParams)
+	if orcaFlag {
+		go orcaUpdater()
+	}
 
-	// enable server reflection
-	reflection.Register(grpcSrv)
-	reflection.Register(grpcsSrv)
+	grpcSwitchLn = listenGrpc(grpcPort)
+	grpcsSwitchLn = listenGrpc(grpcsPort)
+	go serveGrpc(grpcSrv, grpcSwitchLn.newListener())
+	go serveGrpc(grpcsSrv, grpcsSwitchLn.newListener())
+}
 
-	lnCnf := net.ListenConfig{
-		KeepAlive: time.Duration(probeInterval) * time.Second,
-	}
-	if probeInterval == 0 {
-		lnCnf.KeepAlive = -1
-	}
-	go func() {
-		ln, err := lnCnf.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", grpcPort))
-		if err != nil {
-			log.Fatalln(err)
-		}
-		err = grpcSrv.Serve(newGrpcConnListener(ln))
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}()
-	go func() {
-		ln, err := lnCnf.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", grpcsPort))
-		if err != nil {
-			log.Fatalln(err)
-		}
-		err = grpcsSrv.Serve(newGrpcConnListener(ln))
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}()
+func registerGrpcServices(srv *grpc.Server, gelboSrv *gelboServer) {
+	pb.RegisterGelboServiceServer(srv, gelboSrv)
+	pb.RegisterKVServiceServer(srv, newKVServer())
+	pb.RegisterFileServiceServer(srv, newFileServer())
+	registerOrcaService(srv)
+
+	// enable server reflection
+	reflection.Register(srv)
 }
 
 func (s *gelboServer) Unary(ctx context.Context, req *pb.GelboRequest) (*pb.GelboResponse, error) {
@@ -180,6 +161,8 @@ func (s *gelboServer) Unary(ctx context.Context, req *pb.GelboRequest) (*pb.Gelb
 			return resp, nil
 		case err := <-errChan:
 			return nil, err
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
 		}
 	}
 }
@@ -188,6 +171,7 @@ func (s *gelboServer) ClientStream(stream pb.GelboService_ClientStreamServer) er
 	sendChan := make(chan *pb.GelboResponse)
 	errChan := make(chan error, 1)
 	wg := newWaitGroup()
+	defer wg.finish()
 	var latestReq *pb.GelboRequest
 
 	for {
@@ -215,6 +199,8 @@ func (s *gelboServer) ClientStream(stream pb.GelboService_ClientStreamServer) er
 			return err
 		case err := <-errChan:
 			return err
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
 		}
 	}
 }
@@ -225,8 +211,11 @@ func (s *gelboServer) ServerStream(req *pb.GelboRequest, stream pb.GelboService_
 	wg := newWaitGroup()
 	wg.add(1)
 
+	// the waiter below must not be left when returning early (cancellation, deadline, disconnect)
+	defer wg.finish()
+
 	go s.handler(ServerStream, stream.Context(), req, sendChan, errChan, wg)
-	go s.sender(stream, sendChan, errChan, wg)
+	go s.sender(stream.Context(), stream, sendChan, errChan, wg)
 
 	// Wait for either all handlers to finish (normal path) or an error from sender
 	// (e.g. TCP disconnect). In the error case we must NOT close(sendChan) because
@@ -240,6 +229,8 @@ func (s *gelboServer) ServerStream(req *pb.GelboRequest, stream pb.GelboService_
 	case err := <-errChan:
 		return err
 	case <-waitDone:
+	case <-stream.Context().Done():
+		return status.FromContextError(stream.Context().Err()).Err()
 	}
 	close(sendChan)
 	for {
@@ -253,11 +244,13 @@ func (s *gelboServer) ServerStream(req *pb.GelboRequest, stream pb.GelboService_
 func (s *gelboServer) BidiStream(stream pb.GelboService_BidiStreamServer) error {
 	recvChan := make(chan *pb.GelboRequest)
 	sendChan := make(chan *pb.GelboResponse)
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 	wg := newWaitGroup()
+	// the waiter below must not be left when returning early (cancellation, deadline, disconnect)
+	defer wg.finish()
 
-	go s.receiver(stream, recvChan, errChan)
-	go s.sender(stream, sendChan, errChan, wg)
+	go s.receiver(stream.Context(), stream, recvChan, errChan)
+	go s.sender(stream.Context(), stream, sendChan, errChan, wg)
 
 	for {
 		select {
@@ -276,6 +269,8 @@ func (s *gelboServer) BidiStream(stream pb.GelboService_BidiStreamServer) error
 				case err := <-errChan:
 					return err
 				case <-waitDone:
+				case <-stream.Context().Done():
+					return status.FromContextError(stream.Context().Err()).Err()
 				}
 				select {
 				case err := <-errChan:
@@ -289,6 +284,8 @@ func (s *gelboServer) BidiStream(stream pb.GelboService_BidiStreamServer) error
 			go s.handler(BidiStream, stream.Context(), req, sendChan, errChan, wg)
 		case err := <-errChan:
 			return err
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
 		}
 	}
 }
@@ -297,11 +294,31 @@ func (s *gelboServer) handler(mode int, ctx context.Context, req *pb.GelboReques
 	reqInfo := newRequestInfoFromContext(ctx)
 	inputCmds := reqInfo.validateCommandsForGrpc(mode, req)
 	resultCmds := inputCmds.evaluate()
+	setDirectionForGrpcRecord(ctx, inputCmds, resultCmds)
+	setDirectionForSpan(ctx, inputCmds, resultCmds)
+
+	// The rpc method returns when ctx is done, so sending to the channels
+	// must not block after that (e.g. when ignoredeadline is specified).
+	send := func(resp *pb.GelboResponse) {
+		select {
+		case sendChan <- resp:
+		case <-ctx.Done():
+		}
+	}
+	sendErr := func(err error) {
+		select {
+		case errChan <- err:
+		case <-ctx.Done():
+		}
+	}
+	if inputCmds.needsAction() && arrayContains(inputCmds.actions, "ignoredeadline") {
+		defer logOrphanedWork(ctx, reqInfo, time.Now())
+	}
 
 	if inputCmds.needsAction() {
 		if arrayContains(inputCmds.actions, "noop") {
 			if mode == Unary || mode == ClientStream {
-				errChan <- nil
+				sendErr(nil)
 			}
 			wg.done()
 			return
@@ -311,25 +328,61 @@ func (s *gelboServer) handler(mode int, ctx context.Context, req *pb.GelboReques
 			for i := 1; i < repeat; i++ {
 				resultCmds.Repeat = strconv.Itoa(repeat)
 				if err := execGrpcAction(ctx, reqInfo, inputCmds, resultCmds); err != nil {
-					errChan <- err
+					sendErr(err)
 					wg.done()
 					return
 				}
 
 				wg.add(1)
-				sendChan <- createResponse(reqInfo, inputCmds, resultCmds)
+				send(createResponse(ctx, reqInfo, inputCmds, resultCmds))
 				resultCmds = inputCmds.evaluate()
 			}
 		}
 		if err := execGrpcAction(ctx, reqInfo, inputCmds, resultCmds); err != nil {
 			wg.done()
-			errChan <- err
+			sendErr(err)
 			return
 		}
 	}
 	grpc.SetHeader(ctx, metadata.New(headerMDMap.getAll()))
 	grpc.SetTrailer(ctx, metadata.New(trailerMDMap.getAll()))
-	sendChan <- createResponse(reqInfo, inputCmds, resultCmds)
+	send(createResponse(ctx, reqInfo, inputCmds, resultCmds))
+}
+
+// logOrphanedWork logs the work that continued after the rpc was canceled
+// or its deadline was exceeded (ignoredeadline).
+func logOrphanedWork(ctx context.Context, reqInfo *RequestInfo, starttime time.Time) {
+	if ctx.Err() == nil {
+		return
+	}
+	logger := zerolog.New(logOutput).With().
+		Time("starttime", starttime).
+		Str("proto", reqInfo.Proto).
+		Str("method", reqInfo.Method).
+		Str("clientip", reqInfo.ClientIP).
+		Logger()
+	logger.Log().
+		Str("action", "orphaned").
+		Time("endtime", time.Now()).
+		Dur("duration", time.Since(starttime)).
+		Str("ctxerr", ctx.Err().Error()).Msg("")
+}
+
+// sleepWithContext sleeps for d. It returns the status error of ctx when ctx
+// is done before d elapses, unless ignoreDeadline is true.
+func sleepWithContext(ctx context.Context, d time.Duration, ignoreDeadline bool) error {
+	if ignoreDeadline {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
 }
 
 func (reqInfo *RequestInfo) validateCommandsForGrpc(mode int, req *pb.GelboRequest) *Commands {
@@ -372,9 +425,15 @@ func (reqInfo *RequestInfo) validateCommandsForGrpc(mode int, req *pb.GelboReque
 
 func execGrpcAction(ctx context.Context, reqInfo *RequestInfo, inputCmds, resultCmds *Commands) error {
 	if inputCmds.needsAction() {
+		ignoreDeadline := arrayContains(inputCmds.actions, "ignoredeadline")
+		if !ignoreDeadline && ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
 		if arrayContains(inputCmds.actions, "sleep") {
 			sleep, _ := strconv.Atoi(resultCmds.getValue("sleep"))
-			time.Sleep(time.Duration(sleep) * time.Millisecond)
+			if err := sleepWithContext(ctx, time.Duration(sleep)*time.Millisecond, ignoreDeadline); err != nil {
+				return err
+			}
 		}
 		if arrayContains(inputCmds.actions, "cpu") {
 			cpu, _ := strconv.ParseFloat(resultCmds.getValue("cpu"), 64)
@@ -384,6 +443,7 @@ func execGrpcAction(ctx context.Context, reqInfo *RequestInfo, inputCmds, result
 			memory, _ := strconv.ParseFloat(resultCmds.getValue("memory"), 64)
 			store.resource.Memory.setTarget(memory)
 		}
+		applyGrpcParamDirectives(inputCmds, resultCmds)
 		if arrayContains(inputCmds.actions, "addheader") {
 			addHeader := strings.SplitN(resultCmds.getValue("addheader"), ":", 2)
 			headerMDMap.add(addHeader[0], addHeader[1])
@@ -412,7 +472,7 @@ func execGrpcAction(ctx context.Context, reqInfo *RequestInfo, inputCmds, result
 		if arrayContains(inputCmds.actions, "disconnect") {
 			if pr, ok := peer.FromContext(ctx); ok {
 				remoteAddr := pr.Addr.String()
-				disconnect(remoteAddr, reqInfo.Proto, resultCmds.getValue("disconnect") == "rst")
+				disconnect(remoteAddr, strings.TrimPrefix(reqInfo.Proto, "grpc+"), resultCmds.getValue("disconnect") == "rst")
 			}
 			return nil
 		}
@@ -425,7 +485,9 @@ type IStream interface {
 	Recv() (*pb.GelboRequest, error)
 }
 
-func (s *gelboServer) receiver(stream interface{}, recvChan chan *pb.GelboRequest, errChan chan error) {
+// receiver passes the received messages to recvChan until EOF. It returns when ctx is done
+// since nobody reads the channels after the rpc method returned.
+func (s *gelboServer) receiver(ctx context.Context, stream interface{}, recvChan chan *pb.GelboRequest, errChan chan error) {
 	var recvStream IStream
 	recvStream = stream.(IStream)
 	for {
@@ -435,27 +497,57 @@ func (s *gelboServer) receiver(stream interface{}, recvChan chan *pb.GelboReques
 			return
 		}
 		if err != nil {
-			errChan <- err
+			select {
+			case errChan <- err:
+			case <-ctx.Done():
+			}
+			return
+		}
+		select {
+		case recvChan <- msg:
+		case <-ctx.Done():
 			return
 		}
-		recvChan <- msg
 	}
 }
 
-func (s *gelboServer) sender(stream interface{}, sendChan chan *pb.GelboResponse, errChan chan error, wg *WaitGroup) {
+// sender sends the messages of sendChan until it is closed. It returns when ctx is done
+// since sendChan is not closed when the rpc method returned early.
+func (s *gelboServer) sender(ctx context.Context, stream interface{}, sendChan chan *pb.GelboResponse, errChan chan error, wg *WaitGroup) {
 	var sendStream IStream
 	sendStream = stream.(IStream)
-	for msg := range sendChan {
-		if err := sendStream.Send(msg); err != nil {
-			errChan <- err
+	var err error
+loop:
+	for {
+		select {
+		case msg, ok := <-sendChan:
+			if !ok {
+				break loop
+			}
+			if err = sendStream.Send(msg); err != nil {
+				break loop
+			}
+			wg.done()
+		case <-ctx.Done():
 			return
 		}
-		wg.done()
 	}
-	errChan <- nil
+	select {
+	case errChan <- err:
+	case <-ctx.Done():
+	}
 }
 
-func createResponse(reqInfo *RequestInfo, inputCmds, resultCmds *Commands) *pb.GelboResponse {
+func newPbHostInfo() *pb.HostInfo {
+	return &pb.HostInfo{
+		Name: store.host.Name,
+		Ip:   store.host.IP,
+		Az:   store.host.AZ,
+		Type: store.host.InstanceType,
+	}
+}
+
+func createResponse(ctx context.Context, reqInfo *RequestInfo, inputCmds, resultCmds *Commands) *pb.GelboResponse {
 	var data string
 	randSrc := rand.New(rand.NewSource(time.Now().UnixNano()))
 	if inputCmds.needsAction() {
@@ -469,12 +561,7 @@ func createResponse(reqInfo *RequestInfo, inputCmds, resultCmds *Commands) *pb.G
 	}
 
 	return &pb.GelboResponse{
-		Host: &pb.HostInfo{
-			Name: store.host.Name,
-			Ip:   store.host.IP,
-			Az:   store.host.AZ,
-			Type: store.host.InstanceType,
-		},
+		Host: newPbHostInfo(),
 		Resource: &pb.ResourceInfo{
 			Cpu: &pb.ResourceUsage{
 				Target:  store.resource.CPU.getTarget(),
@@ -500,10 +587,26 @@ func createResponse(reqInfo *RequestInfo, inputCmds, resultCmds *Commands) *pb.G
 			Input:  convMapToStrList(convCommandsToMap(inputCmds)),
 			Result: convMapToStrList(convCommandsToMap(resultCmds)),
 		},
-		Data: data,
+		Data:     data,
+		Deadline: newDeadlineInfo(ctx),
 	}
 }
 
+// newDeadlineInfo reports the client's deadline (grpc-timeout) and whether
+// the rpc has been canceled at the time the response is created.
+func newDeadlineInfo(ctx context.Context) *pb.DeadlineInfo {
+	info := &pb.DeadlineInfo{}
+	if deadline, ok := ctx.Deadline(); ok {
+		info.Deadline = deadline.UTC().Format(time.RFC3339Nano)
+		info.Remaining = time.Until(deadline).Milliseconds()
+	}
+	if err := ctx.Err(); err != nil {
+		info.Canceled = true
+		info.Error = err.Error()
+	}
+	return info
+}
+
 // === unregistered method handler
 
 func (s *gelboServer) UnregisteredMethodHandler(srv interface{}, stream grpc.ServerStream) error {
@@ -532,6 +635,9 @@ func (s *gelboServer) UnaryInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		reqsize := getBinarySize(req)
 		logger := initLoggerForUnary(ctx, req, info)
+		countGrpcRequest(ctx)
+		ctx, holder := withGrpcRecordHolder(ctx)
+		ctx, span := startGrpcSpan(ctx, info.FullMethod, logger.proto)
 
 		atomic.AddInt64(&cw.active, 1)
 		if pr, ok := peer.FromContext(ctx); ok {
@@ -545,19 +651,26 @@ func (s *gelboServer) UnaryInterceptor() grpc.UnaryServerInterceptor {
 		}()
 
 		resp, err := handler(ctx, req)
+		endGrpcSpan(span, err)
+		observeGrpcCall(logger.proto, info.FullMethod, err, time.Since(logger.recvtime))
+		var size int64
+		if err == nil {
+			size = getBinarySize(resp)
+		}
+		recentRequests.add(logger.record(ctx, holder, logger.recvtime, reqsize, size, err))
 		if err != nil {
 			var code int32 = 2 // 2 = codes.Unknown
 			if stat, ok := status.FromError(err); ok {
 				code = stat.Proto().Code
 			}
-			logger.forUnary().Log().
+			withCtxErr(logger.forUnary().Log(), ctx).
 				Int64("reqsize", reqsize).
 				Int32("code", code).
 				Time("sendtime", time.Now()).
 				Dur("duration", time.Now().Sub(logger.recvtime)).
 				Str("error", fmt.Sprintf("%v", err)).Msg("")
 		} else {
-			logger.forUnary().Log().
+			withCtxErr(logger.forUnary().Log(), ctx).
 				Int64("reqsize", reqsize).
 				Int64("size", getBinarySize(resp)).
 				Int32("code", 0). // 0 = codes.OK
@@ -570,7 +683,15 @@ func (s *gelboServer) UnaryInterceptor() grpc.UnaryServerInterceptor {
 
 type streamWrapper struct {
 	grpc.ServerStream
-	logger *zerolog.Logger
+	ctx      context.Context
+	logger   *zerolog.Logger
+	recvSize int64
+	sendSize int64
+}
+
+// Context returns the context with the holder of the directives for /requests/
+func (s *streamWrapper) Context() context.Context {
+	return s.ctx
 }
 
 func (s *streamWrapper) RecvMsg(req interface{}) error {
@@ -580,6 +701,7 @@ func (s *streamWrapper) RecvMsg(req interface{}) error {
 		params = tmpReq.String()
 	}
 	if err == nil {
+		atomic.AddInt64(&s.recvSize, getBinarySize(req))
 		s.logger.Log().
 			Str("params", params).
 			Str("action", "recv").
@@ -614,6 +736,7 @@ func (s *streamWrapper) SendMsg(resp interface{}) error {
 			Int64("size", getBinarySize(resp)).
 			Str("error", fmt.Sprintf("%v", err)).Msg("")
 	} else {
+		atomic.AddInt64(&s.sendSize, getBinarySize(resp))
 		s.logger.Log().
 			Str("action", "send").
 			Int32("code", 0). // 0 = codes.OK
@@ -625,8 +748,11 @@ func (s *streamWrapper) SendMsg(resp interface{}) error {
 
 func (s *gelboServer) StreamInterceptor() grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		logger := initLoggerForStream(ss.Context(), info).forStream()
+		grpcLogger := initLoggerForStream(ss.Context(), info)
+		countGrpcRequest(ss.Context())
+		logger := grpcLogger.forStream()
 		logger.Log().Str("action", "open").Msg("")
+		grpcActiveStreams.WithLabelValues(grpcLogger.proto, info.FullMethod).Inc()
 
 		atomic.AddInt64(&cw.active, 1)
 		if pr, ok := peer.FromContext(ss.Context()); ok {
@@ -639,22 +765,32 @@ func (s *gelboServer) StreamInterceptor() grpc.StreamServerInterceptor {
 			}
 		}()
 
-		err := handler(srv, &streamWrapper{ss, logger})
+		ctx, holder := withGrpcRecordHolder(ss.Context())
+		ctx, span := startGrpcSpan(ctx, info.FullMethod, grpcLogger.proto)
+		wrapper := &streamWrapper{ServerStream: ss, ctx: ctx, logger: logger}
+		err := handler(srv, wrapper)
+		endGrpcSpan(span, err)
+		grpcActiveStreams.WithLabelValues(grpcLogger.proto, info.FullMethod).Dec()
+		observeGrpcCall(grpcLogger.proto, info.FullMethod, err, time.Since(grpcLogger.opentime))
+		recentRequests.add(grpcLogger.record(ctx, holder, grpcLogger.opentime,
+			atomic.LoadInt64(&wrapper.recvSize), atomic.LoadInt64(&wrapper.sendSize), err))
 		if err != nil {
 			var code int32 = 2 // 2 = codes.Unknown
 			if stat, ok := status.FromError(err); ok {
 				code = stat.Proto().Code
 			}
-			logger.Log().
+			withCtxErr(logger.Log(), ss.Context()).
 				Str("action", "close").
 				Int32("code", code).
 				Time("closetime", time.Now()).
+				Dur("duration", time.Since(grpcLogger.opentime)).
 				Str("error", fmt.Sprintf("%v", err)).Msg("")
 		} else {
-			logger.Log().
+			withCtxErr(logger.Log(), ss.Context()).
 				Str("action", "close").
 				Int32("code", 0). // 0 = codes.OK
-				Time("closetime", time.Now()).Msg("")
+				Time("closetime", time.Now()).
+				Dur("duration", time.Since(grpcLogger.opentime)).Msg("")
 		}
 		return err
 	}
@@ -766,6 +902,10 @@ func newRequestInfoFromContext(ctx context.Context) *RequestInfo {
 	if mds.TargetPort == grpcsPort {
 		reqInfo.Proto = "grpcs"
 	}
+	// transcoded from HTTP/JSON (e.g. "grpc+http", "grpc+h2")
+	if httpProto, ok := ctx.Value("transcode").(string); ok {
+		reqInfo.Proto = "grpc+" + httpProto
+	}
 	return reqInfo
 }
 
@@ -829,31 +969,41 @@ func setIPAddress(reqInfo *RequestInfo, mds *mdSet) {
 
 func convRequestToMap(req *pb.GelboRequest) map[string][]string {
 	cmds := map[string]string{
-		"cpu":         req.GetCpu(),
-		"memory":      req.GetMemory(),
-		"sleep":       req.GetSleep(),
-		"size":        req.GetSize(),
-		"code":        req.GetCode(),
-		"addheader":   req.GetAddheader(),
-		"delheader":   req.GetDelheader(),
-		"addtrailer":  req.GetAddtrailer(),
-		"deltrailer":  req.GetDeltrailer(),
-		"stdout":      req.GetStdout(),
-		"stderr":      req.GetStderr(),
-		"repeat":      req.GetRepeat(),
-		"dataonly":    req.GetDataonly(),
-		"noop":        req.GetNoop(),
-		"disconnect":  req.GetDisconnect(),
-		"ifclientip":  req.GetIfclientip(),
-		"ifproxy1ip":  req.GetIfproxy1Ip(),
-		"ifproxy2ip":  req.GetIfproxy2Ip(),
-		"ifproxy3ip":  req.GetIfproxy3Ip(),
-		"iflasthopip": req.GetIflasthopip(),
-		"iftargetip":  req.GetIftargetip(),
-		"ifhostip":    req.GetIfhostip(),
-		"ifhost":      req.GetIfhost(),
-		"ifaz":        req.GetIfaz(),
-		"iftype":      req.GetIftype(),
+		"cpu":             req.GetCpu(),
+		"memory":          req.GetMemory(),
+		"sleep":           req.GetSleep(),
+		"size":            req.GetSize(),
+		"code":            req.GetCode(),
+		"addheader":       req.GetAddheader(),
+		"delheader":       req.GetDelheader(),
+		"addtrailer":      req.GetAddtrailer(),
+		"deltrailer":      req.GetDeltrailer(),
+		"stdout":          req.GetStdout(),
+		"stderr":          req.GetStderr(),
+		"repeat":          req.GetRepeat(),
+		"dataonly":        req.GetDataonly(),
+		"noop":            req.GetNoop(),
+		"disconnect":      req.GetDisconnect(),
+		"grpcping":        req.GetGrpcping(),
+		"grpcpingtimeout": req.GetGrpcpingtimeout(),
+		"grpcmaxidle":     req.GetGrpcmaxidle(),
+		"grpcmaxage":      req.GetGrpcmaxage(),
+		"grpcmaxagegrace": req.GetGrpcmaxagegrace(),
+		"grpcminpingtime": req.GetGrpcminpingtime(),
+		"grpcmaxstreams":  req.GetGrpcmaxstreams(),
+		"grpcwindow":      req.GetGrpcwindow(),
+		"grpcconnwindow":  req.GetGrpcconnwindow(),
+		"ignoredeadline":  req.GetIgnoredeadline(),
+		"ifclientip":      req.GetIfclientip(),
+		"ifproxy1ip":      req.GetIfproxy1Ip(),
+		"ifproxy2ip":      req.GetIfproxy2Ip(),
+		"ifproxy3ip":      req.GetIfproxy3Ip(),
+		"iflasthopip":     req.GetIflasthopip(),
+		"iftargetip":      req.GetIftargetip(),
+		"ifhostip":        req.GetIfhostip(),
+		"ifhost":          req.GetIfhost(),
+		"ifaz":            req.GetIfaz(),
+		"iftype":          req.GetIftype(),
 	}
 	cmdsMap := map[string][]string{}
 	for key, value := range cmds {
@@ -866,31 +1016,41 @@ func convRequestToMap(req *pb.GelboRequest) map[string][]string {
 
 func convCommandsToMap(cmds *Commands) map[string]string {
 	tmpMap := map[string]string{
-		"cpu":         cmds.CPU,
-		"memory":      cmds.Memory,
-		"sleep":       cmds.Sleep,
-		"size":        cmds.Size,
-		"code":        cmds.Code,
-		"addheader":   cmds.AddHeader,
-		"delheader":   cmds.DelHeader,
-		"addtrailer":  cmds.AddTrailer,
-		"deltrailer":  cmds.DelTrailer,
-		"stdout":      cmds.Stdout,
-		"stderr":      cmds.Stderr,
-		"repeat":      cmds.Repeat,
-		"dataonly":    cmds.DataOnly,
-		"noop":        cmds.Noop,
-		"disconnect":  cmds.Disconnect,
-		"ifclientip":  cmds.IfClientIP,
-		"ifproxy1ip":  cmds.IfProxy1IP,
-		"ifproxy2ip":  cmds.IfProxy2IP,
-		"ifproxy3ip":  cmds.IfProxy3IP,
-		"iflasthopip": cmds.IfLasthopIP,
-		"iftargetip":  cmds.IfTargetIP,
-		"ifhostip":    cmds.IfHostIP,
-		"ifhost":      cmds.IfHost,
-		"ifaz":        cmds.IfAZ,
-		"iftype":      cmds.IfType,
+		"cpu":             cmds.CPU,
+		"memory":          cmds.Memory,
+		"sleep":           cmds.Sleep,
+		"size":            cmds.Size,
+		"code":            cmds.Code,
+		"addheader":       cmds.AddHeader,
+		"delheader":       cmds.DelHeader,
+		"addtrailer":      cmds.AddTrailer,
+		"deltrailer":      cmds.DelTrailer,
+		"stdout":          cmds.Stdout,
+		"stderr":          cmds.Stderr,
+		"repeat":          cmds.Repeat,
+		"dataonly":        cmds.DataOnly,
+		"noop":            cmds.Noop,
+		"disconnect":      cmds.Disconnect,
+		"grpcping":        cmds.GrpcPing,
+		"grpcpingtimeout": cmds.GrpcPingTimeout,
+		"grpcmaxidle":     cmds.GrpcMaxIdle,
+		"grpcmaxage":      cmds.GrpcMaxAge,
+		"grpcmaxagegrace": cmds.GrpcMaxAgeGrace,
+		"grpcminpingtime": cmds.GrpcMinPingTime,
+		"grpcmaxstreams":  cmds.GrpcMaxStreams,
+		"grpcwindow":      cmds.GrpcWindow,
+		"grpcconnwindow":  cmds.GrpcConnWindow,
+		"ignoredeadline":  cmds.IgnoreDeadline,
+		"ifclientip":      cmds.IfClientIP,
+		"ifproxy1ip":      cmds.IfProxy1IP,
+		"ifproxy2ip":      cmds.IfProxy2IP,
+		"ifproxy3ip":      cmds.IfProxy3IP,
+		"iflasthopip":     cmds.IfLasthopIP,
+		"iftargetip":      cmds.IfTargetIP,
+		"ifhostip":        cmds.IfHostIP,
+		"ifhost":          cmds.IfHost,
+		"ifaz":            cmds.IfAZ,
+		"iftype":          cmds.IfType,
 	}
 
 	cmdsMap := map[string]string{}
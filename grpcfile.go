@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	pb "github.com/miyaz/gelbo/grpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultFileChunkSize = 64 * 1024
+	maxFileChunkSize     = 4 * 1024 * 1024 // keep below the default grpc max message size
+	maxStoredFileSize    = 64 * 1024 * 1024
+	maxStoredFilesSize   = 256 * 1024 * 1024
+)
+
+var files = newFileStore()
+
+// fileServer implements elbgrpc.FileService.
+// Uploaded files are kept in memory only while they fit within the size caps.
+type fileServer struct {
+	pb.UnimplementedFileServiceServer
+}
+
+func newFileServer() *fileServer {
+	return &fileServer{}
+}
+
+// FileStore ... in-memory file store with exclusive control
+type FileStore struct {
+	*sync.RWMutex
+	m     map[string][]byte
+	total int
+}
+
+func newFileStore() *FileStore {
+	return &FileStore{
+		RWMutex: &sync.RWMutex{},
+		m:       make(map[string][]byte),
+	}
+}
+
+func (fs *FileStore) get(name string) ([]byte, bool) {
+	fs.RLock()
+	defer fs.RUnlock()
+	data, ok := fs.m[name]
+	return data, ok
+}
+
+func (fs *FileStore) put(name string, data []byte) bool {
+	fs.Lock()
+	defer fs.Unlock()
+	total := fs.total - len(fs.m[name]) + len(data)
+	if total > maxStoredFilesSize {
+		return false
+	}
+	fs.m[name] = data
+	fs.total = total
+	return true
+}
+
+// Upload receives chunks until EOF and verifies the sha256 sent with the last chunk (if any)
+func (s *fileServer) Upload(stream pb.FileService_UploadServer) error {
+	var name, clientSum string
+	var size int64
+	var chunks int32
+	var data []byte
+	storable := true
+	hash := sha256.New()
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if chunk.GetName() != "" {
+			name = chunk.GetName()
+		}
+		if chunk.GetOffset() != size {
+			return status.Errorf(codes.InvalidArgument, "unexpected offset %d (expected %d)", chunk.GetOffset(), size)
+		}
+		hash.Write(chunk.GetData())
+		size += int64(len(chunk.GetData()))
+		chunks++
+		if chunk.GetSha256() != "" {
+			clientSum = chunk.GetSha256()
+		}
+		if storable && name != "" && size <= maxStoredFileSize {
+			data = append(data, chunk.GetData()...)
+		} else {
+			storable, data = false, nil
+		}
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if clientSum != "" && clientSum != sum {
+		return status.Errorf(codes.DataLoss, "sha256 mismatch: client=%s server=%s", clientSum, sum)
+	}
+	stored := storable && name != "" && files.put(name, data)
+	return stream.SendAndClose(&pb.FileUploadResponse{
+		Host:   newPbHostInfo(),
+		Name:   name,
+		Size:   size,
+		Chunks: chunks,
+		Sha256: sum,
+		Stored: stored,
+	})
+}
+
+// Download streams a stored file by name, or random data of the requested size.
+// The sha256 of the whole content is set on the last chunk.
+func (s *fileServer) Download(req *pb.FileDownloadRequest, stream pb.FileService_DownloadServer) error {
+	chunkSize := int64(req.GetChunkSize())
+	if chunkSize <= 0 {
+		chunkSize = defaultFileChunkSize
+	} else if chunkSize > maxFileChunkSize {
+		chunkSize = maxFileChunkSize
+	}
+
+	var data []byte
+	size := req.GetSize()
+	if req.GetName() != "" && size == 0 {
+		stored, ok := files.get(req.GetName())
+		if !ok {
+			return status.Errorf(codes.NotFound, "file %q not found", req.GetName())
+		}
+		data = stored
+		size = int64(len(data))
+	} else if size < 0 {
+		return status.Error(codes.InvalidArgument, "size must not be negative")
+	}
+
+	randSrc := rand.New(rand.NewSource(time.Now().UnixNano()))
+	hash := sha256.New()
+	for offset := int64(0); offset < size || offset == 0; offset += chunkSize {
+		n := min(chunkSize, size-offset)
+		var buf []byte
+		if data != nil {
+			buf = data[offset : offset+n]
+		} else {
+			buf = randBytes(randSrc, int(n))
+		}
+		hash.Write(buf)
+		chunk := &pb.FileChunk{Name: req.GetName(), Offset: offset, Data: buf}
+		if offset+n >= size {
+			chunk.Sha256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		if size == 0 {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/miyaz/gelbo/grpc/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const kvWatchBufferSize = 256
+
+var kvs = newKVStore()
+
+// kvServer implements elbgrpc.KVService backed by an in-memory store.
+// The store is per gelbo instance (not shared between targets).
+type kvServer struct {
+	pb.UnimplementedKVServiceServer
+}
+
+func newKVServer() *kvServer {
+	return &kvServer{}
+}
+
+// KVStore ... in-memory key-value store with exclusive control
+type KVStore struct {
+	*sync.RWMutex
+	m        map[string]*pb.KVEntry
+	version  int64
+	watchers map[chan *pb.KVEntry]string // channel -> key prefix
+}
+
+func newKVStore() *KVStore {
+	return &KVStore{
+		RWMutex:  &sync.RWMutex{},
+		m:        make(map[string]*pb.KVEntry),
+		watchers: make(map[chan *pb.KVEntry]string),
+	}
+}
+
+func (kv *KVStore) get(key string) (*pb.KVEntry, bool) {
+	kv.RLock()
+	defer kv.RUnlock()
+	entry, ok := kv.m[key]
+	return entry, ok
+}
+
+func (kv *KVStore) put(key string, value []byte) *pb.KVEntry {
+	kv.Lock()
+	defer kv.Unlock()
+	kv.version++
+	entry := &pb.KVEntry{
+		Key:       key,
+		Value:     value,
+		Version:   kv.version,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	kv.m[key] = entry
+	for ch, prefix := range kv.watchers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		// slow watchers miss events instead of blocking Put
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+	return entry
+}
+
+func (kv *KVStore) list(prefix string, limit int) []*pb.KVEntry {
+	kv.RLock()
+	keys := []string{}
+	for key := range kv.m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	kv.RUnlock()
+	slices.Sort(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	entries := []*pb.KVEntry{}
+	for _, key := range keys {
+		if entry, ok := kv.get(key); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (kv *KVStore) watch(prefix string) chan *pb.KVEntry {
+	kv.Lock()
+	defer kv.Unlock()
+	ch := make(chan *pb.KVEntry, kvWatchBufferSize)
+	kv.watchers[ch] = prefix
+	return ch
+}
+
+func (kv *KVStore) unwatch(ch chan *pb.KVEntry) {
+	kv.Lock()
+	defer kv.Unlock()
+	delete(kv.watchers, ch)
+}
+
+func (s *kvServer) Get(ctx context.Context, req *pb.KVGetRequest) (*pb.KVGetResponse, error) {
+	entry, ok := kvs.get(req.GetKey())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "key %q not found", req.GetKey())
+	}
+	return &pb.KVGetResponse{Host: newPbHostInfo(), Entry: entry}, nil
+}
+
+func (s *kvServer) Put(ctx context.Context, req *pb.KVPutRequest) (*pb.KVPutResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is empty")
+	}
+	entry := kvs.put(req.GetKey(), req.GetValue())
+	return &pb.KVPutResponse{Host: newPbHostInfo(), Entry: entry}, nil
+}
+
+func (s *kvServer) List(ctx context.Context, req *pb.KVListRequest) (*pb.KVListResponse, error) {
+	entries := kvs.list(req.GetPrefix(), int(req.GetLimit()))
+	return &pb.KVListResponse{Host: newPbHostInfo(), Entries: entries}, nil
+}
+
+// Watch streams Put events of keys with the specified prefix until the client cancels.
+func (s *kvServer) Watch(req *pb.KVWatchRequest, stream pb.KVService_WatchServer) error {
+	ch := kvs.watch(req.GetPrefix())
+	defer kvs.unwatch(ch)
+	for {
+		select {
+		case entry := <-ch:
+			event := &pb.KVEvent{Host: newPbHostInfo(), Type: "put", Entry: entry}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
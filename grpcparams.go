@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+var (
+	grpcPingTimeout     int
+	grpcMaxConnIdle     int
+	grpcMaxConnAge      int
+	grpcMaxConnAgeGrace int
+	grpcMinPingTime     int
+	grpcMaxStreams      int
+	grpcWindowSize      int
+	grpcConnWindowSize  int
+
+	grpcParamsMu  = &sync.Mutex{}
+	curGrpcParams GrpcServerParams
+	grpcSwitchLn  *grpcSwitchListener
+	grpcsSwitchLn *grpcSwitchListener
+)
+
+// grpcParamDirectives ... directives that change the gRPC server parameters at runtime
+var grpcParamDirectives = []string{
+	"grpcping", "grpcpingtimeout", "grpcmaxidle", "grpcmaxage", "grpcmaxagegrace",
+	"grpcminpingtime", "grpcmaxstreams", "grpcwindow", "grpcconnwindow",
+}
+
+// GrpcServerParams ... keepalive, connection age and flow-control parameters of gRPC servers
+type GrpcServerParams struct {
+	PingInterval    int `json:"grpcping"`
+	PingTimeout     int `json:"grpcpingtimeout"`
+	MaxConnIdle     int `json:"grpcmaxidle"`
+	MaxConnAge      int `json:"grpcmaxage"`
+	MaxConnAgeGrace int `json:"grpcmaxagegrace"`
+	MinPingTime     int `json:"grpcminpingtime"`
+	MaxStreams      int `json:"grpcmaxstreams"`
+	WindowSize      int `json:"grpcwindow"`
+	ConnWindowSize  int `json:"grpcconnwindow"`
+}
+
+func getGrpcParamsFromFlags() GrpcServerParams {
+	return GrpcServerParams{
+		PingInterval:    grpcInterval,
+		PingTimeout:     grpcPingTimeout,
+		MaxConnIdle:     grpcMaxConnIdle,
+		MaxConnAge:      grpcMaxConnAge,
+		MaxConnAgeGrace: grpcMaxConnAgeGrace,
+		MinPingTime:     grpcMinPingTime,
+		MaxStreams:      grpcMaxStreams,
+		WindowSize:      grpcWindowSize,
+		ConnWindowSize:  grpcConnWindowSize,
+	}
+}
+
+func (p *GrpcServerParams) set(key string, value int) {
+	switch key {
+	case "grpcping":
+		p.PingInterval = value
+	case "grpcpingtimeout":
+		p.PingTimeout = value
+	case "grpcmaxidle":
+		p.MaxConnIdle = value
+	case "grpcmaxage":
+		p.MaxConnAge = value
+	case "grpcmaxagegrace":
+		p.MaxConnAgeGrace = value
+	case "grpcminpingtime":
+		p.MinPingTime = value
+	case "grpcmaxstreams":
+		p.MaxStreams = value
+	case "grpcwindow":
+		p.WindowSize = value
+	case "grpcconnwindow":
+		p.ConnWindowSize = value
+	}
+}
+
+// serverOptions converts the parameters to grpc.ServerOption.
+// 0 means the default value of grpc-go (except grpcping, see -grpcping).
+func (p *GrpcServerParams) serverOptions() []grpc.ServerOption {
+	kaep := keepalive.EnforcementPolicy{
+		MinTime:             time.Duration(p.MinPingTime) * time.Second,
+		PermitWithoutStream: true,
+	}
+	kasp := keepalive.ServerParameters{
+		Time:                  time.Duration(p.PingInterval) * time.Second,
+		Timeout:               time.Duration(p.PingTimeout) * time.Second,
+		MaxConnectionIdle:     time.Duration(p.MaxConnIdle) * time.Second,
+		MaxConnectionAge:      time.Duration(p.MaxConnAge) * time.Second,
+		MaxConnectionAgeGrace: time.Duration(p.MaxConnAgeGrace) * time.Second,
+	}
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(kaep),
+		grpc.KeepaliveParams(kasp),
+	}
+	if p.MaxStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(uint32(p.MaxStreams)))
+	}
+	if p.WindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(int32(p.WindowSize)))
+	}
+	if p.ConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(int32(p.ConnWindowSize)))
+	}
+	return opts
+}
+
+// applyGrpcParamDirectives changes the gRPC server parameters specified by directives.
+func applyGrpcParamDirectives(inputCmds, resultCmds *Commands) {
+	values := map[string]int{}
+	for _, key := range grpcParamDirectives {
+		if arrayContains(inputCmds.actions, key) {
+			values[key], _ = strconv.Atoi(resultCmds.getValue(key))
+		}
+	}
+	if len(values) > 0 {
+		updateGrpcServers(values)
+	}
+}
+
+// updateGrpcServers replaces grpc/grpcs servers with servers created with the current
+// parameters changed by values. The parameters are changed under the lock so that
+// concurrent directives changing different parameters do not revert each other.
+// The new servers accept new connections on the same ports, and the old servers are
+// stopped gracefully (existing connections receive GOAWAY and are closed after
+// in-flight RPCs finish).
+func updateGrpcServers(values map[string]int) {
+	grpcParamsMu.Lock()
+	defer grpcParamsMu.Unlock()
+	if grpcSrv == nil || shuttingDown.Load() {
+		return
+	}
+	params := curGrpcParams
+	for key, value := range values {
+		params.set(key, value)
+	}
+	if params == curGrpcParams {
+		return
+	}
+	curGrpcParams = params
+	oldSrv, oldSrvs := grpcSrv, grpcsSrv
+	grpcSrv, grpcsSrv = newGrpcServers(params)
+	// new connections are handed over only to the new servers after newListener
+	go serveGrpc(grpcSrv, grpcSwitchLn.newListener())
+	go serveGrpc(grpcsSrv, grpcsSwitchLn.newListener())
+	go oldSrv.GracefulStop()
+	go oldSrvs.GracefulStop()
+
+	logger := zerolog.New(logOutput).With().Time("time", time.Now()).Logger()
+	logger.Log().Interface("params", params).Msg("grpc server params updated")
+}
+
+func serveGrpc(srv *grpc.Server, ln net.Listener) {
+	// ErrServerStopped: the server was replaced before it started serving
+	if err := srv.Serve(ln); err != nil && err != grpc.ErrServerStopped {
+		log.Fatalln(err)
+	}
+}
+
+// grpcSwitchListener accepts connections from the listening socket and hands
+// them over to the current gRPC server, so that the server can be replaced
+// without closing the listening port.
+type grpcSwitchListener struct {
+	net.Listener
+	mu    sync.Mutex
+	cur   *grpcSubListener // the listener of the current server
+	start sync.Once
+}
+
+func newGrpcSwitchListener(ln net.Listener) *grpcSwitchListener {
+	return &grpcSwitchListener{Listener: ln}
+}
+
+// acceptLoop hands over each connection to the current listener. The lock is held until
+// it is received, so that a connection is never handed over to a replaced server
+// (which would close it when it is stopped).
+func (l *grpcSwitchListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		l.mu.Lock()
+		cur := l.cur
+		if err != nil {
+			cur.errs <- err
+			l.mu.Unlock()
+			return
+		}
+		select {
+		case cur.conns <- conn:
+		case <-cur.done:
+			// the server is stopped (shutting down)
+			conn.Close()
+		}
+		l.mu.Unlock()
+	}
+}
+
+// newListener returns the listener for a new server, which replaces the current listener.
+func (l *grpcSwitchListener) newListener() net.Listener {
+	sub := &grpcSubListener{parent: l, conns: make(chan net.Conn), errs: make(chan error, 1), done: make(chan struct{})}
+	l.mu.Lock()
+	l.cur = sub
+	l.mu.Unlock()
+	l.start.Do(func() { go l.acceptLoop() })
+	return sub
+}
+
+// grpcSubListener is the listener for each gRPC server. Close does not close
+// the listening socket.
+type grpcSubListener struct {
+	parent *grpcSwitchListener
+	conns  chan net.Conn
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *grpcSubListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *grpcSubListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *grpcSubListener) Addr() net.Addr {
+	return l.parent.Addr()
+}
+
+// goAwayLoggingCreds wraps TransportCredentials to log GOAWAY frames sent by the
+// server (e.g. max_idle, max_age, too_many_pings) after the (TLS) handshake.
+type goAwayLoggingCreds struct {
+	credentials.TransportCredentials
+	proto string
+}
+
+func newGoAwayLoggingCreds(creds credentials.TransportCredentials, proto string) credentials.TransportCredentials {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	return &goAwayLoggingCreds{TransportCredentials: creds, proto: proto}
+}
+
+func (c *goAwayLoggingCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		return conn, authInfo, err
+	}
+	cs, _ := grpcConnState(rawConn)
+	if cs != nil && c.TransportCredentials.Info().SecurityProtocol == "tls" {
+		cs.setTLSHandshake(start, time.Now())
+	}
+	return &goAwayLoggingConn{Conn: conn, proto: c.proto, opentime: time.Now(), cs: cs}, authInfo, nil
+}
+
+func (c *goAwayLoggingCreds) Clone() credentials.TransportCredentials {
+	return &goAwayLoggingCreds{TransportCredentials: c.TransportCredentials.Clone(), proto: c.proto}
+}
+
+// goAwayLoggingConn parses HTTP/2 frames written to the connection and logs GOAWAY frames.
+type goAwayLoggingConn struct {
+	net.Conn
+	proto    string
+	opentime time.Time
+	cs       *ConnState // nil if the connection is not tracked
+	mu       sync.Mutex
+	header   []byte // frame header being read (9 bytes)
+	remain   int    // payload bytes of the current frame not yet read
+	payload  []byte // payload of the current GOAWAY frame
+	isGoAway bool
+}
+
+func (c *goAwayLoggingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.parse(p[:n])
+	return n, err
+}
+
+func (c *goAwayLoggingConn) parse(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(p) > 0 {
+		if c.remain == 0 && !c.isGoAway {
+			// read frame header
+			need := 9 - len(c.header)
+			if len(p) < need {
+				c.header = append(c.header, p...)
+				return
+			}
+			c.header = append(c.header, p[:need]...)
+			p = p[need:]
+			length := int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+			c.isGoAway = http2.FrameType(c.header[3]) == http2.FrameGoAway
+			c.remain = length
+			c.header = c.header[:0]
+			c.payload = c.payload[:0]
+		}
+		n := min(c.remain, len(p))
+		if c.isGoAway {
+			c.payload = append(c.payload, p[:n]...)
+		}
+		c.remain -= n
+		p = p[n:]
+		if c.remain == 0 && c.isGoAway {
+			c.logGoAway()
+			c.isGoAway = false
+		}
+	}
+}
+
+func (c *goAwayLoggingConn) logGoAway() {
+	if len(c.payload) < 8 {
+		return
+	}
+	if c.cs != nil {
+		if tracked, ok := c.cs.conn.(*grpcTrackedConn); ok {
+			tracked.goAwaySent.Store(true)
+		}
+	}
+	lastStreamID := binary.BigEndian.Uint32(c.payload[0:4]) & (1<<31 - 1)
+	errCode := http2.ErrCode(binary.BigEndian.Uint32(c.payload[4:8]))
+	remoteAddr := c.Conn.RemoteAddr().String()
+	logger := zerolog.New(logOutput).With().
+		Time("opentime", c.opentime).
+		Str("proto", c.proto).
+		Str("srcip", extractIPAddress(remoteAddr)).
+		Int("srcport", extractPort(remoteAddr)).
+		Logger()
+	logger.Log().
+		Str("action", "goaway").
+		Time("sendtime", time.Now()).
+		Uint32("laststreamid", lastStreamID).
+		Str("errcode", errCode.String()).
+		Str("debugdata", string(c.payload[8:])).
+		Dur("connage", time.Since(c.opentime)).Msg("")
+}
+
+// newGrpcServers creates grpc and grpcs servers with the specified parameters.
+func newGrpcServers(params GrpcServerParams) (*grpc.Server, *grpc.Server) {
+	gelboSrv1 := newGelboServer()
+	srv := grpc.NewServer(append(append(params.serverOptions(), orcaServerOptions()...),
+		grpc.MaxSendMsgSize(grpcMaxSendMsgSize),
+		grpc.MaxRecvMsgSize(grpcMaxRecvMsgSize),
+		grpc.Creds(newGoAwayLoggingCreds(nil, "grpc")),
+		grpc.UnaryInterceptor(gelboSrv1.UnaryInterceptor()),
+		grpc.StreamInterceptor(gelboSrv1.StreamInterceptor()),
+		grpc.UnknownServiceHandler(gelboSrv1.UnregisteredMethodHandler),
+	)...)
+	gelboSrv2 := newGelboServer()
+	srvs := grpc.NewServer(append(append(params.serverOptions(), orcaServerOptions()...),
+		grpc.MaxSendMsgSize(grpcMaxSendMsgSize),
+		grpc.MaxRecvMsgSize(grpcMaxRecvMsgSize),
+		grpc.Creds(newGoAwayLoggingCreds(credentials.NewTLS(loadTLSConfig()), "grpcs")),
+		grpc.UnaryInterceptor(gelboSrv2.UnaryInterceptor()),
+		grpc.StreamInterceptor(gelboSrv2.StreamInterceptor()),
+		grpc.UnknownServiceHandler(gelboSrv2.UnregisteredMethodHandler),
+	)...)
+	registerGrpcServices(srv, gelboSrv1)
+	registerGrpcServices(srvs, gelboSrv2)
+	return srv, srvs
+}
+
+func listenGrpc(port int) *grpcSwitchListener {
+	lnCnf := net.ListenConfig{
+		KeepAlive: time.Duration(probeInterval) * time.Second,
+	}
+	if probeInterval == 0 {
+		lnCnf.KeepAlive = -1
+	}
+	ln, err := lnCnf.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return newGrpcSwitchListener(newGrpcConnListener(ln))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const historyNodeName = "node"
+
+var (
+	historySeconds int
+	historyMinutes int
+	history        = NewHistoryStore()
+)
+
+// RPS windows per resolution (number of points)
+var historyWindows = map[string][]int{
+	"second": {1, 10, 60, 300},
+	"minute": {1, 5, 15, 60},
+}
+
+// HistoryPoint ... snapshot of NodeInfo at sampled_at
+type HistoryPoint struct {
+	SampledAt     int64   `json:"sampled_at"`
+	RequestCount  int64   `json:"request_count"`
+	Requests      int64   `json:"requests"` // since the previous point
+	RPS           float64 `json:"rps"`      // requests per second since the previous point
+	SentBytes     int64   `json:"sent_bytes"`
+	ReceivedBytes int64   `json:"received_bytes"`
+	ActiveConns   int64   `json:"active_conns"`
+	TotalConns    int64   `json:"total_conns"`
+	CPU           float64 `json:"cpu"`
+	Memory        float64 `json:"memory"`
+}
+
+// RPSWindow ... average requests per second over the window
+type RPSWindow struct {
+	Window string  `json:"window"`
+	RPS    float64 `json:"rps"`
+}
+
+// NodeHistory ... history of a node in /monitor/?history response
+type NodeHistory struct {
+	RPS    []RPSWindow    `json:"rps"`
+	Points []HistoryPoint `json:"points"`
+}
+
+// HistoryResult ... response of /monitor/?history
+type HistoryResult struct {
+	Resolution string                  `json:"resolution"`
+	Node       *NodeHistory            `json:"node,omitempty"`
+	ELBs       map[string]*NodeHistory `json:"elbs,omitempty"`
+}
+
+// historyRing ... fixed size ring buffer of points
+type historyRing struct {
+	points []HistoryPoint
+	next   int
+	full   bool
+	prev   HistoryPoint // the latest point (the counters at creation before the first point)
+}
+
+// newHistoryRing keeps size points plus one more, the base of the rate over all the size points
+func newHistoryRing(size int, created int64) *historyRing {
+	return &historyRing{points: make([]HistoryPoint, size+1), prev: HistoryPoint{SampledAt: created}}
+}
+
+func (hr *historyRing) add(point HistoryPoint) {
+	point.Requests = point.RequestCount - hr.prev.RequestCount
+	if point.Requests < 0 {
+		// counters were reset
+		point.Requests = point.RequestCount
+	}
+	if elapsed := time.Duration(point.SampledAt - hr.prev.SampledAt).Seconds(); elapsed > 0 {
+		point.RPS = roundRPS(float64(point.Requests) / elapsed)
+	}
+	hr.points[hr.next] = point
+	hr.next = (hr.next + 1) % len(hr.points)
+	if hr.next == 0 {
+		hr.full = true
+	}
+	hr.prev = point
+}
+
+// last returns the last n points (including the base point) from the oldest
+func (hr *historyRing) last(n int) []HistoryPoint {
+	var points []HistoryPoint
+	if hr.full {
+		points = append(points, hr.points[hr.next:]...)
+	}
+	points = append(points, hr.points[:hr.next]...)
+	if n < len(points) {
+		points = points[len(points)-n:]
+	}
+	return points
+}
+
+// list returns the last n points (0 = all) from the oldest
+func (hr *historyRing) list(n int) []HistoryPoint {
+	if size := len(hr.points) - 1; n <= 0 || n > size {
+		n = size
+	}
+	return hr.last(n)
+}
+
+// rps returns the average requests per second over the last n points
+func (hr *historyRing) rps(n int) (float64, bool) {
+	points := hr.last(n + 1)
+	if len(points) < n+1 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	elapsed := time.Duration(last.SampledAt - first.SampledAt).Seconds()
+	if elapsed <= 0 || last.RequestCount < first.RequestCount {
+		return 0, false // counters were reset in the window
+	}
+	return roundRPS(float64(last.RequestCount-first.RequestCount) / elapsed), true
+}
+
+func roundRPS(rps float64) float64 {
+	return math.Round(rps*1000) / 1000
+}
+
+type nodeHistory struct {
+	second *historyRing
+	minute *historyRing
+}
+
+// HistoryStore ... per-second/per-minute history of the node and each ELB node with exclusive control
+type HistoryStore struct {
+	*sync.RWMutex
+	m map[string]*nodeHistory
+}
+
+// NewHistoryStore ... create HistoryStore instance
+func NewHistoryStore() *HistoryStore {
+	return &HistoryStore{&sync.RWMutex{}, make(map[string]*nodeHistory)}
+}
+
+func (hs *HistoryStore) add(name string, node *NodeInfo, sampledAt int64, everyMinute bool) {
+	node.RLock()
+	point := HistoryPoint{
+		SampledAt:     sampledAt,
+		RequestCount:  node.RequestCount,
+		SentBytes:     node.SentBytes,
+		ReceivedBytes: node.ReceivedBytes,
+		ActiveConns:   node.ActiveConns,
+		TotalConns:    node.TotalConns,
+		CPU:           node.CPU,
+		Memory:        node.Memory,
+	}
+	created := node.CreatedAt
+	node.RUnlock()
+
+	hs.Lock()
+	defer hs.Unlock()
+	nh, ok := hs.m[name]
+	if !ok {
+		nh = &nodeHistory{
+			second: newHistoryRing(historySeconds, created),
+			minute: newHistoryRing(historyMinutes, created),
+		}
+		hs.m[name] = nh
+	}
+	nh.second.add(point)
+	if everyMinute {
+		nh.minute.add(point)
+	}
+}
+
+func (hs *HistoryStore) get(name, resolution string, last int) *NodeHistory {
+	hs.RLock()
+	defer hs.RUnlock()
+	nh, ok := hs.m[name]
+	if !ok {
+		return nil
+	}
+	ring, unit := nh.second, "s"
+	if resolution == "minute" {
+		ring, unit = nh.minute, "m"
+	}
+	result := &NodeHistory{RPS: []RPSWindow{}, Points: ring.list(last)}
+	for _, n := range historyWindows[resolution] {
+		if rps, ok := ring.rps(n); ok {
+			result.RPS = append(result.RPS, RPSWindow{Window: fmt.Sprintf("%d%s", n, unit), RPS: rps})
+		}
+	}
+	return result
+}
+
+// historySampler takes a snapshot of the node and each ELB node every second (and every minute)
+func historySampler() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for tick := 1; ; tick++ {
+		now := <-t.C
+		updateNode()
+		everyMinute := tick%60 == 0
+		store.node.RLock()
+		elbs := make(map[string]*NodeInfo, len(store.node.ELBs))
+		for ip, node := range store.node.ELBs {
+			elbs[ip] = node
+		}
+		store.node.RUnlock()
+		history.add(historyNodeName, store.node, now.UnixNano(), everyMinute)
+		for ip, node := range elbs {
+			history.add(ip, node, now.UnixNano(), everyMinute)
+		}
+	}
+}
+
+func parseHistoryResolution(value string) (string, error) {
+	switch value {
+	case "", "second", "1s":
+		return "second", nil
+	case "minute", "1m":
+		return "minute", nil
+	}
+	return "", fmt.Errorf("invalid history: %s", value)
+}
+
+// historyHandler serves /monitor/?history[=second|minute][&last=N][&node=node|ELB IP][&format=csv]
+func historyHandler(w http.ResponseWriter, r *http.Request, rawFlag bool) {
+	qsMap := r.URL.Query()
+	resolution, err := parseHistoryResolution(qsMap.Get("history"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var last int
+	if value := qsMap.Get("last"); value != "" {
+		if last, err = strconv.Atoi(value); err != nil || last < 0 {
+			http.Error(w, fmt.Sprintf("invalid last: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+	target := qsMap.Get("node")
+
+	result := HistoryResult{Resolution: resolution, ELBs: map[string]*NodeHistory{}}
+	history.RLock()
+	names := make([]string, 0, len(history.m))
+	for name := range history.m {
+		names = append(names, name)
+	}
+	history.RUnlock()
+	for _, name := range names {
+		if target != "" && target != name {
+			continue
+		}
+		if name == historyNodeName {
+			result.Node = history.get(name, resolution, last)
+		} else {
+			result.ELBs[name] = history.get(name, resolution, last)
+		}
+	}
+
+	if qsMap.Get("format") == "csv" {
+		writeHistoryCSV(w, result)
+		return
+	}
+	writeMonitorJSON(w, result, rawFlag)
+}
+
+func writeHistoryCSV(w http.ResponseWriter, result HistoryResult) {
+	w.Header().Set("Content-Type", "text/csv")
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"node", "sampled_at", "request_count", "requests", "rps", "sent_bytes", "received_bytes", "active_conns", "total_conns", "cpu", "memory"})
+	writeNode := func(name string, nh *NodeHistory) {
+		for _, p := range nh.Points {
+			csvWriter.Write([]string{
+				name,
+				time.Unix(0, p.SampledAt).UTC().Format(time.RFC3339),
+				strconv.FormatInt(p.RequestCount, 10),
+				strconv.FormatInt(p.Requests, 10),
+				strconv.FormatFloat(p.RPS, 'f', 3, 64),
+				strconv.FormatInt(p.SentBytes, 10),
+				strconv.FormatInt(p.ReceivedBytes, 10),
+				strconv.FormatInt(p.ActiveConns, 10),
+				strconv.FormatInt(p.TotalConns, 10),
+				strconv.FormatFloat(p.CPU, 'f', 1, 64),
+				strconv.FormatFloat(p.Memory, 'f', 1, 64),
+			})
+		}
+	}
+	if result.Node != nil {
+		writeNode(historyNodeName, result.Node)
+	}
+	ips := make([]string, 0, len(result.ELBs))
+	for ip := range result.ELBs {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		writeNode(ip, result.ELBs[ip])
+	}
+	csvWriter.Flush()
+}
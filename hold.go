@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultHoldEvent = "default"
+
+var holds = NewHoldStore()
+
+// HoldStore ... requests held by /hold/ with exclusive control (oldest first)
+type HoldStore struct {
+	*sync.Mutex
+	held []*heldRequest
+}
+
+type heldRequest struct {
+	event   string
+	since   time.Time
+	release chan string // receives the reason of release
+}
+
+// HoldResult ... response of held requests
+type HoldResult struct {
+	Host     HostInfo `json:"host"`
+	Event    string   `json:"event"`
+	Reason   string   `json:"reason"`
+	HeldTime int64    `json:"heldTime"` // milliseconds
+}
+
+// HoldStatus ... response of /hold/status
+type HoldStatus struct {
+	Host   HostInfo       `json:"host"`
+	Held   int            `json:"held"`
+	Events map[string]int `json:"events"`
+	Oldest int64          `json:"oldest,omitempty"` // held time of the oldest request (milliseconds)
+}
+
+// HoldReleaseResult ... response of /hold/release (status after the release)
+type HoldReleaseResult struct {
+	Released int `json:"released"`
+	HoldStatus
+}
+
+// NewHoldStore ... create HoldStore instance
+func NewHoldStore() *HoldStore {
+	return &HoldStore{&sync.Mutex{}, []*heldRequest{}}
+}
+
+func (hs *HoldStore) add(event string) *heldRequest {
+	hs.Lock()
+	defer hs.Unlock()
+	req := &heldRequest{event: event, since: time.Now(), release: make(chan string, 1)}
+	hs.held = append(hs.held, req)
+	return req
+}
+
+// remove returns false if the request has already been released
+func (hs *HoldStore) remove(req *heldRequest) bool {
+	hs.Lock()
+	defer hs.Unlock()
+	for i, held := range hs.held {
+		if held == req {
+			hs.held = append(hs.held[:i], hs.held[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release releases count requests (0 = all) from the oldest. all events if event is empty.
+func (hs *HoldStore) release(event string, count int) int {
+	hs.Lock()
+	defer hs.Unlock()
+	released := 0
+	remains := []*heldRequest{}
+	for _, held := range hs.held {
+		if (event == "" || held.event == event) && (count == 0 || released < count) {
+			held.release <- "released"
+			released++
+		} else {
+			remains = append(remains, held)
+		}
+	}
+	hs.held = remains
+	return released
+}
+
+func (hs *HoldStore) status() HoldStatus {
+	hs.Lock()
+	defer hs.Unlock()
+	status := HoldStatus{Host: *store.getHostInfo(), Held: len(hs.held), Events: map[string]int{}}
+	for _, held := range hs.held {
+		status.Events[held.event]++
+	}
+	if len(hs.held) > 0 {
+		status.Oldest = time.Since(hs.held[0].since).Milliseconds()
+	}
+	return status
+}
+
+// holdHandler holds requests until released by /hold/release, timeout or the client goes away.
+func holdHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/hold/release":
+		holdReleaseHandler(w, r)
+		return
+	case "/hold/status":
+		writeHoldJSON(w, r, http.StatusOK, holds.status())
+		return
+	}
+
+	qsMap := r.URL.Query()
+	event := qsMap.Get("event")
+	if event == "" {
+		event = defaultHoldEvent
+	}
+	var timeout time.Duration
+	if value := qsMap.Get("timeout"); value != "" {
+		msec, err := strconv.Atoi(value)
+		if err != nil || msec < 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout: %s", value), http.StatusBadRequest)
+			setStatusForLogger(http.StatusBadRequest, r)
+			return
+		}
+		timeout = time.Duration(msec) * time.Millisecond
+	}
+
+	reqInfo := newRequestInfo(r)
+	inputCmds := reqInfo.validateCommands(qsMap)
+	resultCmds := inputCmds.evaluate()
+
+	held := holds.add(event)
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	var reason string
+	select {
+	case reason = <-held.release:
+	case <-timer:
+		reason = "timeout"
+	case <-r.Context().Done():
+		reason = "canceled"
+	}
+	if reason != "released" && !holds.remove(held) {
+		// released at the same time
+		reason = <-held.release
+	}
+	if reason == "canceled" {
+		setStatusForLogger(499, r) // client closed request
+		return
+	}
+
+	statusCode := http.StatusOK
+	if inputCmds.needsAction() && arrayContains(inputCmds.actions, "status") {
+		statusCode, _ = strconv.Atoi(resultCmds.getValue("status"))
+	}
+	respSize := writeHoldJSON(w, r, statusCode, HoldResult{
+		Host:     *store.getHostInfo(),
+		Event:    event,
+		Reason:   reason,
+		HeldTime: time.Since(held.since).Milliseconds(),
+	})
+	store.node.reflectRequest(0, respSize)
+	remoteNodes.m[extractIPAddress(r.RemoteAddr)].reflectRequest(0, respSize)
+}
+
+// holdReleaseHandler releases held requests. ?event= selects the event (default: all) and ?count= the number (default: all)
+func holdReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	qsMap := r.URL.Query()
+	count := 0
+	if value := qsMap.Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 0 {
+			http.Error(w, fmt.Sprintf("invalid count: %s", value), http.StatusBadRequest)
+			setStatusForLogger(http.StatusBadRequest, r)
+			return
+		}
+	}
+	released := holds.release(qsMap.Get("event"), count)
+	writeHoldJSON(w, r, http.StatusOK, HoldReleaseResult{Released: released, HoldStatus: holds.status()})
+}
+
+func writeHoldJSON(w http.ResponseWriter, r *http.Request, statusCode int, v interface{}) int64 {
+	respJSON, _ := jsonMarshalIndent(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(respJSON)))
+	w.WriteHeader(statusCode)
+	w.Write(respJSON)
+	setRespSizeForLogger(int64(len(respJSON)), r)
+	setStatusForLogger(statusCode, r)
+	return int64(len(respJSON))
+}
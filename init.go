@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,7 +18,8 @@ var (
 	runOnEC2 bool
 )
 
-func init() {
+// initialize parses the flags (or runs the subcommand) and prepares the settings of gelbo
+func initialize() {
 	flag.IntVar(&httpPort, "http", 80, "http port")
 	flag.IntVar(&httpsPort, "https", 443, "https port")
 	flag.IntVar(&grpcPort, "grpc", 50051, "grpc port")
@@ -25,14 +27,55 @@ func init() {
 	flag.IntVar(&idleTimeout, "timeout", 65, "idle timeout. if 0 is specified, no limit")
 	flag.IntVar(&probeInterval, "interval", 15, "tcp-keepalive probe interval. if 0 is specified, probe is not sent")
 	flag.IntVar(&grpcInterval, "grpcping", 30, "grpc ping frame interval. if 0 is specified, ping frame is not sent")
+	flag.IntVar(&grpcPingTimeout, "grpcpingtimeout", 20, "grpc ping ack timeout (seconds)")
+	flag.IntVar(&grpcMaxConnIdle, "grpcmaxidle", 0, "grpc max connection idle (seconds). if 0 is specified, no limit")
+	flag.IntVar(&grpcMaxConnAge, "grpcmaxage", 0, "grpc max connection age (seconds). if 0 is specified, no limit")
+	flag.IntVar(&grpcMaxConnAgeGrace, "grpcmaxagegrace", 0, "grpc max connection age grace (seconds). if 0 is specified, no limit")
+	flag.IntVar(&grpcMinPingTime, "grpcminpingtime", 300, "grpc minimum interval of client pings (seconds). pings more frequent than this cause GOAWAY(too_many_pings)")
+	flag.IntVar(&grpcMaxStreams, "grpcmaxstreams", 0, "grpc max concurrent streams per connection. if 0 is specified, no limit")
+	flag.IntVar(&grpcWindowSize, "grpcwindow", 0, "grpc initial stream window size (bytes). if 0 is specified, dynamic window (BDP estimation)")
+	flag.IntVar(&grpcConnWindowSize, "grpcconnwindow", 0, "grpc initial connection window size (bytes). if 0 is specified, dynamic window (BDP estimation)")
 	flag.Int64Var(&wsInterval, "wsping", 30, "websocket ping interval")
-	//flag.Int64Var(&maxMessageSize, "wsmaxsize", 1024, "websocket max message size")
+	flag.Int64Var(&maxMessageSize, "wsmaxsize", 1024, "websocket max message size (bytes). if 0 is specified, no limit")
+	flag.IntVar(&upgrader.ReadBufferSize, "wsreadbuf", 1024, "websocket read buffer size (bytes)")
+	flag.IntVar(&upgrader.WriteBufferSize, "wswritebuf", 1024, "websocket write buffer size (bytes)")
+	flag.StringVar(&wsOrigins, "wsorigins", "", "comma-separated list of allowed websocket origins. if empty, all origins are allowed")
+	flag.StringVar(&wsSubprotocols, "wssubprotocols", "", "comma-separated list of supported websocket subprotocols in order of preference")
+	flag.BoolVar(&upgrader.EnableCompression, "wscompress", false, "enable websocket permessage-deflate compression")
+	flag.StringVar(&wsBackendName, "wsbackend", "local", "websocket broadcast backend (local, peer or redis)")
+	flag.StringVar(&wsPeers, "wspeers", "", "comma-separated list of other gelbo instances (host:port or URL) for -wsbackend peer")
+	flag.StringVar(&wsRedisAddr, "wsredis", "", "redis address (host:port or redis[s]:// URL) for -wsbackend redis")
 	flag.IntVar(&grpcMaxRecvMsgSize, "grpcmaxrecvsize", 4194304, "grpc max recv size")
 	flag.IntVar(&grpcMaxSendMsgSize, "grpcmaxsendsize", 4194304, "grpc max send size")
+	flag.BoolVar(&orcaFlag, "orca", true, "enable ORCA load reports (per-call trailer and OOB service)")
+	flag.IntVar(&orcaMinInterval, "orcainterval", 1, "minimum ORCA OOB load report interval (seconds)")
+	flag.StringVar(&fleetPeers, "peers", "", "comma-separated list of other gelbo instances (host[:port] or URL) for /fleet/")
+	flag.StringVar(&fleetPeerDNS, "peerdns", "", "DNS name[:port] resolving to the addresses of gelbo instances for /fleet/")
+	flag.StringVar(&fleetPeerTag, "peertag", "", "EC2 tag (key=value) of the instances running gelbo for /fleet/")
+	flag.IntVar(&fleetPeerPort, "peerport", 80, "http port of the peers when omitted in -peers, -peerdns and -peertag")
+	flag.StringVar(&fleetEC2Endpoint, "peerec2endpoint", "", "EC2 API endpoint URL for -peertag (e.g. a mock server)")
+	flag.IntVar(&historySeconds, "historysec", 300, "number of per-second statistics snapshots kept for /monitor/?history")
+	flag.IntVar(&historyMinutes, "historymin", 60, "number of per-minute statistics snapshots kept for /monitor/?history=minute")
+	flag.StringVar(&logFormat, "logformat", "json", "access log format (json, logfmt, combined or alb)")
+	flag.StringVar(&logFields, "logfields", "", "comma-separated list of access log fields for json and logfmt (header:Name adds a request header). if empty, all fields")
+	flag.StringVar(&logFile, "logfile", "", "access log file path. if empty, access logs are written to stdout")
+	flag.IntVar(&logMaxSize, "logmaxsize", 100, "max size (megabytes) of -logfile before it is rotated")
+	flag.IntVar(&logMaxBackups, "logmaxbackups", 5, "max number of rotated -logfile kept. if 0 is specified, no limit")
+	flag.IntVar(&logMaxAge, "logmaxage", 0, "max days to keep rotated -logfile. if 0 is specified, no limit")
+	flag.IntVar(&requestsMax, "requestsmax", 1000, "number of recent requests kept for /requests/. if 0 is specified, requests are not kept")
+	flag.StringVar(&captureFile, "capture", "", "file the incoming http requests are captured to (JSONL, appended). replayed by the replay subcommand")
+	flag.Int64Var(&captureMaxBody, "capturemaxbody", 1048576, "maximum bytes of the request body captured")
+	flag.StringVar(&otlpEndpoint, "otlpendpoint", "", "OTLP/HTTP endpoint the trace spans are exported to (e.g. http://localhost:4318). if not specified, tracing is disabled")
+	flag.StringVar(&otlpService, "otlpservice", "gelbo", "service.name of the trace spans")
+	flag.Float64Var(&traceSample, "tracesample", 1.0, "sampling ratio of the traces not sampled by the caller (0-1)")
+	flag.BoolVar(&connLogFlag, "connlog", false, "enable connection lifecycle event logging (accept, tls, first_request, idle, hijack, close)")
 	flag.BoolVar(&execFlag, "exec", false, "enable exec feature")
 	flag.BoolVar(&proxyFlag, "proxy", false, "enable proxy protocol")
 	flag.BoolVar(&noLogFlag, "nolog", false, "disable access logging")
 	flag.Parse()
+	if flag.NArg() > 0 {
+		runSubcommand(flag.Arg(0), flag.Args()[1:])
+	}
 	if probeInterval < 0 {
 		fmt.Printf("invalid value \"%d\" for flag -interval: less than zero\n", probeInterval)
 		os.Exit(2)
@@ -41,10 +84,87 @@ func init() {
 		fmt.Printf("invalid value \"%d\" for flag -grpcping: less than zero\n", grpcInterval)
 		os.Exit(2)
 	}
+	for name, value := range map[string]int{
+		"grpcpingtimeout": grpcPingTimeout,
+		"grpcmaxidle":     grpcMaxConnIdle,
+		"grpcmaxage":      grpcMaxConnAge,
+		"grpcmaxagegrace": grpcMaxConnAgeGrace,
+		"grpcminpingtime": grpcMinPingTime,
+		"grpcmaxstreams":  grpcMaxStreams,
+		"grpcwindow":      grpcWindowSize,
+		"grpcconnwindow":  grpcConnWindowSize,
+	} {
+		if value < 0 {
+			fmt.Printf("invalid value \"%d\" for flag -%s: less than zero\n", value, name)
+			os.Exit(2)
+		}
+	}
+	if orcaMinInterval <= 0 {
+		fmt.Printf("invalid value \"%d\" for flag -orcainterval: zero or less\n", orcaMinInterval)
+		os.Exit(2)
+	}
 	if wsInterval <= 0 {
 		fmt.Printf("invalid value \"%d\" for flag -wsping: zero or less\n", wsInterval)
 		os.Exit(2)
 	}
+	if !slices.Contains([]string{"local", "peer", "redis"}, wsBackendName) {
+		fmt.Printf("invalid value \"%s\" for flag -wsbackend: must be local, peer or redis\n", wsBackendName)
+		os.Exit(2)
+	}
+	if maxMessageSize < 0 {
+		fmt.Printf("invalid value \"%d\" for flag -wsmaxsize: less than zero\n", maxMessageSize)
+		os.Exit(2)
+	}
+	for name, value := range map[string]int{
+		"wsreadbuf":  upgrader.ReadBufferSize,
+		"wswritebuf": upgrader.WriteBufferSize,
+	} {
+		if value <= 0 {
+			fmt.Printf("invalid value \"%d\" for flag -%s: zero or less\n", value, name)
+			os.Exit(2)
+		}
+	}
+	for name, value := range map[string]int{
+		"historysec": historySeconds,
+		"historymin": historyMinutes,
+	} {
+		if value <= 0 {
+			fmt.Printf("invalid value \"%d\" for flag -%s: zero or less\n", value, name)
+			os.Exit(2)
+		}
+	}
+	if requestsMax < 0 {
+		fmt.Printf("invalid value \"%d\" for flag -requestsmax: less than zero\n", requestsMax)
+		os.Exit(2)
+	}
+	if captureMaxBody < 0 {
+		fmt.Printf("invalid value \"%d\" for flag -capturemaxbody: less than zero\n", captureMaxBody)
+		os.Exit(2)
+	}
+	if traceSample < 0 || traceSample > 1 {
+		fmt.Printf("invalid value \"%v\" for flag -tracesample: out of range\n", traceSample)
+		os.Exit(2)
+	}
+	if fleetPeerPort <= 0 || fleetPeerPort > 65535 {
+		fmt.Printf("invalid value \"%d\" for flag -peerport: out of range\n", fleetPeerPort)
+		os.Exit(2)
+	}
+	if err := initPeerDiscoverers(); err != nil {
+		fmt.Printf("invalid value \"%s\" for flag -peertag: %v\n", fleetPeerTag, err)
+		os.Exit(2)
+	}
+	if err := initAccessLog(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := initTracing(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := initCapture(); err != nil {
+		fmt.Printf("invalid value \"%s\" for flag -capture: %v\n", captureFile, err)
+		os.Exit(2)
+	}
 	zlog := zerolog.New(os.Stderr).Level(zerolog.DebugLevel).With().
 		Int("http", httpPort).
 		Int("https", httpsPort).
@@ -53,10 +173,48 @@ func init() {
 		Int("timeout", idleTimeout).
 		Int("interval", probeInterval).
 		Int("grpcping", grpcInterval).
+		Int("grpcpingtimeout", grpcPingTimeout).
+		Int("grpcmaxidle", grpcMaxConnIdle).
+		Int("grpcmaxage", grpcMaxConnAge).
+		Int("grpcmaxagegrace", grpcMaxConnAgeGrace).
+		Int("grpcminpingtime", grpcMinPingTime).
+		Int("grpcmaxstreams", grpcMaxStreams).
+		Int("grpcwindow", grpcWindowSize).
+		Int("grpcconnwindow", grpcConnWindowSize).
 		Int("wsping", int(wsInterval)).
-		//Int("wsmaxsize", int(maxMessageSize)).
+		Int("wsmaxsize", int(maxMessageSize)).
+		Int("wsreadbuf", upgrader.ReadBufferSize).
+		Int("wswritebuf", upgrader.WriteBufferSize).
+		Str("wsorigins", wsOrigins).
+		Str("wssubprotocols", wsSubprotocols).
+		Bool("wscompress", upgrader.EnableCompression).
+		Str("wsbackend", wsBackendName).
+		Str("wspeers", wsPeers).
+		Str("wsredis", wsRedisAddr).
 		Int("grpcmaxrecvsize", int(grpcMaxRecvMsgSize)).
 		Int("grpcmaxsendsize", int(grpcMaxSendMsgSize)).
+		Bool("orca", orcaFlag).
+		Int("orcainterval", orcaMinInterval).
+		Str("peers", fleetPeers).
+		Str("peerdns", fleetPeerDNS).
+		Str("peertag", fleetPeerTag).
+		Int("peerport", fleetPeerPort).
+		Str("peerec2endpoint", fleetEC2Endpoint).
+		Int("historysec", historySeconds).
+		Int("historymin", historyMinutes).
+		Str("logformat", logFormat).
+		Str("logfields", logFields).
+		Str("logfile", logFile).
+		Int("logmaxsize", logMaxSize).
+		Int("logmaxbackups", logMaxBackups).
+		Int("logmaxage", logMaxAge).
+		Int("requestsmax", requestsMax).
+		Str("capture", captureFile).
+		Int64("capturemaxbody", captureMaxBody).
+		Str("otlpendpoint", otlpEndpoint).
+		Str("otlpservice", otlpService).
+		Float64("tracesample", traceSample).
+		Bool("connlog", connLogFlag).
 		Bool("exec", execFlag).
 		Bool("proxy", proxyFlag).
 		Bool("nolog", noLogFlag).Logger()
@@ -76,7 +234,10 @@ func init() {
 	pingPeriod = time.Duration(wsInterval) * time.Second // Send pings to peer with this period. Must be less than pongWait.
 	pongWait = pingPeriod * 10 / 9                       // Time allowed to read the next pong message from the peer.
 	writeWait = 10 * time.Second                         // Time allowed to write a message to the peer.
-	maxMessageSize = 1024                                // Maximum message size allowed from peer.
+	upgrader.CheckOrigin = checkOrigin
+	if wsSubprotocols != "" {
+		upgrader.Subprotocols = splitAndTrim(wsSubprotocols)
+	}
 }
 
 func getMetaDataType() string {
@@ -166,6 +166,9 @@ func runLambda() {
 	// Remove unsupported commands in Lambda environment
 	delete(store.validatorForHttp, "cpu")
 	delete(store.validatorForHttp, "memory")
+	for _, key := range grpcParamDirectives {
+		delete(store.validatorForHttp, key)
+	}
 
 	lambda.Start(lambdaHandler)
 }
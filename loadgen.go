@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pb "github.com/miyaz/gelbo/grpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// unknownTarget is the target of the responses without the host info (e.g. the body replaced by size)
+const unknownTarget = "unknown"
+
+// loadProtos are the protocols of the load subcommand and the schemes of -target they accept
+var loadProtos = map[string][]string{
+	"http1": {"http", "https"},
+	"h2":    {"https"},
+	"h2c":   {"http"},
+	"grpc":  {"grpc", "grpcs"},
+	"ws":    {"ws", "wss"},
+}
+
+// loadOptions ... the options of the load subcommand
+type loadOptions struct {
+	target     *url.URL
+	proto      string
+	method     string
+	directives url.Values
+	timeout    time.Duration
+	insecure   bool
+	newConn    bool
+}
+
+// loadResult ... the result of a request. status is empty if no response was received.
+type loadResult struct {
+	status  string
+	failed  bool
+	target  string
+	latency time.Duration
+}
+
+// loadSender sends requests of the protocol. each worker has its own sender (connection).
+type loadSender interface {
+	send() loadResult
+	close()
+}
+
+// LoadStats ... ClientStats of all requests and of each target (host.name/host.ip in the responses)
+type LoadStats struct {
+	*sync.Mutex
+	all     *ClientStats
+	targets map[string]*ClientStats
+}
+
+// LoadSummary ... the summary of LoadStats
+type LoadSummary struct {
+	ClientSummary
+	Targets map[string]*LoadTargetSummary `json:"targets"`
+}
+
+// LoadTargetSummary ... the summary of a target
+type LoadTargetSummary struct {
+	Ratio float64 `json:"ratio"` // percentage of the responses
+	ClientSummary
+}
+
+func newLoadStats() *LoadStats {
+	return &LoadStats{Mutex: &sync.Mutex{}, all: newClientStats(), targets: map[string]*ClientStats{}}
+}
+
+func (s *LoadStats) add(result loadResult) {
+	s.all.add(result.status, result.failed, result.latency)
+	if result.status == "" {
+		return
+	}
+	s.Lock()
+	stats, ok := s.targets[result.target]
+	if !ok {
+		stats = newClientStats()
+		stats.start = s.all.start
+		s.targets[result.target] = stats
+	}
+	s.Unlock()
+	stats.add(result.status, result.failed, result.latency)
+}
+
+func (s *LoadStats) summary() LoadSummary {
+	summary := LoadSummary{ClientSummary: s.all.summary(), Targets: map[string]*LoadTargetSummary{}}
+	s.Lock()
+	defer s.Unlock()
+	responses := 0
+	for target, stats := range s.targets {
+		summary.Targets[target] = &LoadTargetSummary{ClientSummary: stats.summary()}
+		responses += summary.Targets[target].Total
+	}
+	for _, targetSummary := range summary.Targets {
+		targetSummary.Ratio = math.Round(float64(targetSummary.Total)/float64(responses)*10000) / 100
+	}
+	return summary
+}
+
+// targetName returns the key of the target from the host info in the response
+func targetName(name, ip string) string {
+	switch {
+	case name != "" && ip != "":
+		return fmt.Sprintf("%s (%s)", name, ip)
+	case ip != "":
+		return ip
+	case name != "":
+		return name
+	}
+	return unknownTarget
+}
+
+// runLoad sends the requests at a fixed rate or concurrency and prints the summary per target
+func runLoad(args []string) int {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	target := fs.String("target", "", "URL the requests are sent to. http(s)://, grpc(s)://host:port or ws(s)://host/ws/ (required)")
+	proto := fs.String("proto", "", "http1, h2, h2c, grpc or ws (default: by the scheme of -target. http1 for http(s))")
+	method := fs.String("method", http.MethodGet, "method of HTTP requests")
+	directives := fs.String("directives", "", "directives embedded in the requests in the query string format (e.g. sleep=100&status=503)")
+	concurrency := fs.Int("concurrency", 10, "number of workers sending requests concurrently (each worker has its own connection)")
+	rate := fs.Float64("rate", 0, "requests per second of all workers. if 0 is specified, each worker sends the next request as soon as it gets the response")
+	duration := fs.Duration("duration", 10*time.Second, "duration to send requests. if 0 is specified, until -n requests are sent")
+	requests := fs.Int("n", 0, "number of requests to send. if 0 is specified, until -duration elapses")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each request")
+	insecureFlag := fs.Bool("insecure", false, "skip verifying the certificate of the target")
+	newConn := fs.Bool("newconn", false, "use a new connection for each request to spread the requests over the targets behind the load balancer")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	opts, err := newLoadOptions(*target, *proto, *method, *directives)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	opts.timeout, opts.insecure, opts.newConn = *timeout, *insecureFlag, *newConn
+	if *concurrency <= 0 {
+		fmt.Printf("invalid value \"%d\" for flag -concurrency: zero or less\n", *concurrency)
+		return 2
+	}
+	if *rate < 0 {
+		fmt.Printf("invalid value \"%v\" for flag -rate: less than zero\n", *rate)
+		return 2
+	}
+	// the interval of the requests must be 1ns or more
+	if !(*rate <= float64(time.Second)) {
+		fmt.Printf("invalid value \"%v\" for flag -rate: greater than %d\n", *rate, time.Second)
+		return 2
+	}
+	if *duration < 0 || *requests < 0 || (*duration == 0 && *requests == 0) {
+		fmt.Println("either flag -duration or -n must be greater than zero")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	summary, err := load(ctx, opts, *concurrency, *rate, int64(*requests))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	summaryJSON, _ := jsonMarshalIndent(summary)
+	fmt.Println(string(summaryJSON))
+	return 0
+}
+
+func newLoadOptions(target, proto, method, directives string) (*loadOptions, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid value \"%s\" for flag -target: not URL", target)
+	}
+	if proto == "" {
+		for name, schemes := range loadProtos {
+			if name != "h2" && name != "h2c" && arrayContains(schemes, u.Scheme) {
+				proto = name
+			}
+		}
+	}
+	schemes, ok := loadProtos[proto]
+	if !ok {
+		return nil, fmt.Errorf("invalid value \"%s\" for flag -proto: not http1, h2, h2c, grpc or ws", proto)
+	}
+	if !arrayContains(schemes, u.Scheme) {
+		return nil, fmt.Errorf("invalid value \"%s\" for flag -target: scheme of %s must be %v", target, proto, schemes)
+	}
+	values, err := url.ParseQuery(directives)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value \"%s\" for flag -directives: %v", directives, err)
+	}
+	if proto == "ws" && len(values) > 0 {
+		return nil, fmt.Errorf("invalid value \"%s\" for flag -directives: not supported by ws", directives)
+	}
+	return &loadOptions{target: u, proto: proto, method: method, directives: values}, nil
+}
+
+// load runs the workers until ctx is done or the number of requests reaches max
+func load(ctx context.Context, opts *loadOptions, concurrency int, rate float64, max int64) (LoadSummary, error) {
+	senders := make([]loadSender, concurrency)
+	for i := range senders {
+		sender, err := newLoadSender(opts)
+		if err != nil {
+			for _, s := range senders[:i] {
+				s.close()
+			}
+			return LoadSummary{}, err
+		}
+		senders[i] = sender
+	}
+
+	var tokens chan struct{}
+	if rate > 0 {
+		tokens = make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case tokens <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	stats := newLoadStats()
+	var sent int64
+	wg := &sync.WaitGroup{}
+	for _, sender := range senders {
+		wg.Add(1)
+		go func(sender loadSender) {
+			defer wg.Done()
+			defer sender.close()
+			for {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+						return
+					}
+				} else if ctx.Err() != nil {
+					return
+				}
+				if max > 0 && atomic.AddInt64(&sent, 1) > max {
+					return
+				}
+				stats.add(sender.send())
+			}
+		}(sender)
+	}
+	wg.Wait()
+	return stats.summary(), nil
+}
+
+func newLoadSender(opts *loadOptions) (loadSender, error) {
+	switch opts.proto {
+	case "grpc":
+		return newGrpcLoadSender(opts)
+	case "ws":
+		return &wsLoadSender{opts: opts}, nil
+	default:
+		return newHTTPLoadSender(opts), nil
+	}
+}
+
+// === HTTP (http1, h2, h2c)
+
+type httpLoadSender struct {
+	client *http.Client
+	method string
+	url    string
+}
+
+func newHTTPLoadSender(opts *loadOptions) *httpLoadSender {
+	transport := newClientTransport(opts.insecure, 1)
+	transport.DisableKeepAlives = opts.newConn
+	transport.Protocols = &http.Protocols{}
+	switch opts.proto {
+	case "h2":
+		transport.Protocols.SetHTTP2(true)
+	case "h2c":
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		transport.Protocols.SetHTTP1(true)
+	}
+	u := *opts.target
+	query := u.Query()
+	for key, values := range opts.directives {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return &httpLoadSender{
+		client: &http.Client{
+			Transport:     transport,
+			Timeout:       opts.timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		method: opts.method,
+		url:    u.String(),
+	}
+}
+
+func (s *httpLoadSender) send() loadResult {
+	start := time.Now()
+	req, err := http.NewRequest(s.method, s.url, nil)
+	if err != nil {
+		return loadResult{}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return loadResult{}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	result := loadResult{
+		status:  strconv.Itoa(resp.StatusCode),
+		failed:  resp.StatusCode >= 500,
+		latency: time.Since(start),
+	}
+	var respInfo ResponseInfo
+	json.Unmarshal(body, &respInfo)
+	result.target = targetName(respInfo.Host.Name, respInfo.Host.IP)
+	return result
+}
+
+func (s *httpLoadSender) close() {
+	s.client.CloseIdleConnections()
+}
+
+// === gRPC (unary calls)
+
+type grpcLoadSender struct {
+	opts   *loadOptions
+	req    *pb.GelboRequest
+	creds  credentials.TransportCredentials
+	conn   *grpc.ClientConn
+	client pb.GelboServiceClient
+}
+
+func newGrpcLoadSender(opts *loadOptions) (*grpcLoadSender, error) {
+	directives := map[string]string{}
+	for key := range opts.directives {
+		directives[key] = opts.directives.Get(key)
+	}
+	directivesJSON, _ := json.Marshal(directives)
+	req := &pb.GelboRequest{}
+	if err := protojson.Unmarshal(directivesJSON, req); err != nil {
+		return nil, fmt.Errorf("invalid value \"%s\" for flag -directives: %v", opts.directives.Encode(), err)
+	}
+	s := &grpcLoadSender{opts: opts, req: req, creds: insecure.NewCredentials()}
+	if opts.target.Scheme == "grpcs" {
+		s.creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: opts.insecure})
+	}
+	if !opts.newConn {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *grpcLoadSender) connect() error {
+	conn, err := grpc.NewClient(s.opts.target.Host, grpc.WithTransportCredentials(s.creds))
+	if err != nil {
+		return err
+	}
+	s.conn, s.client = conn, pb.NewGelboServiceClient(conn)
+	return nil
+}
+
+func (s *grpcLoadSender) send() loadResult {
+	start := time.Now()
+	if s.opts.newConn {
+		if err := s.connect(); err != nil {
+			return loadResult{}
+		}
+		defer s.close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.timeout)
+	defer cancel()
+	resp, err := s.client.Unary(ctx, s.req)
+	stat, _ := status.FromError(err)
+	result := loadResult{status: stat.Code().String(), failed: err != nil, latency: time.Since(start), target: unknownTarget}
+	if resp.GetHost() != nil {
+		result.target = targetName(resp.GetHost().GetName(), resp.GetHost().GetIp())
+	}
+	return result
+}
+
+func (s *grpcLoadSender) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// === WebSocket (whoAmI messages)
+
+type wsLoadSender struct {
+	opts *loadOptions
+	conn *websocket.Conn
+}
+
+func (s *wsLoadSender) connect() error {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: s.opts.timeout,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: s.opts.insecure},
+	}
+	conn, _, err := dialer.Dial(s.opts.target.String(), nil)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// send sends whoAmI and waits for yourInfo (other messages such as the broadcasts are skipped)
+func (s *wsLoadSender) send() loadResult {
+	start := time.Now()
+	if s.conn == nil || s.opts.newConn {
+		if err := s.connect(); err != nil {
+			return loadResult{}
+		}
+		if s.opts.newConn {
+			defer s.close()
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.opts.timeout))
+	s.conn.SetReadDeadline(time.Now().Add(s.opts.timeout))
+	if err := s.conn.WriteJSON(WsData{Type: "whoAmI"}); err != nil {
+		s.close()
+		return loadResult{}
+	}
+	for {
+		var data WsData
+		if err := s.conn.ReadJSON(&data); err != nil {
+			s.close()
+			return loadResult{}
+		}
+		if data.Type == "yourInfo" {
+			return loadResult{status: "OK", latency: time.Since(start), target: targetName("", data.User.HostIP)}
+		}
+	}
+}
+
+func (s *wsLoadSender) close() {
+	if s.conn != nil {
+		s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/miyaz/gelbo/grpc/pb"
@@ -29,6 +30,18 @@ type HttpLogger struct {
 	time       time.Time
 	duration   time.Duration
 	reuse      int64
+	httpver    string
+	host       string
+	useragent  string
+	referer    string
+	traceid    string
+	targetaddr string
+	headers    map[string]string // -logfields header:Name
+	timing     RequestTiming
+	header     http.Header // kept for /requests/ (-requestsmax)
+	direction  *Direction
+	rawquery   string // kept for -capture
+	body       []byte // kept for -capture (up to -capturemaxbody)
 }
 
 func (l *HttpLogger) init(r *http.Request, reuse int64) {
@@ -39,8 +52,58 @@ func (l *HttpLogger) init(r *http.Request, reuse int64) {
 	l.qstr, _ = url.QueryUnescape(r.URL.Query().Encode())
 	l.clientip = getClientIPAddress(r)
 	l.remoteaddr = r.RemoteAddr
-	l.reqsize, _ = io.Copy(io.Discard, r.Body)
+	if captureEnabled() {
+		l.rawquery = r.URL.RawQuery
+		l.body, l.reqsize = readBodyForCapture(r.Body)
+	} else {
+		l.reqsize, _ = io.Copy(io.Discard, r.Body)
+	}
+	l.timing.body = time.Since(l.reqtime)
+	l.reuse = reuse
+	l.setRequestHeaders(r)
+}
+
+// initForStream is like init but leaves the request body to the handler
+// (e.g. for streaming requests). reqsize counts the bytes the handler reads.
+func (l *HttpLogger) initForStream(r *http.Request, reuse int64) {
+	l.reqtime = time.Now()
+	l.proto, _ = r.Context().Value("proto").(string)
+	l.method = r.Method
+	l.path = r.URL.EscapedPath()
+	l.qstr, _ = url.QueryUnescape(r.URL.Query().Encode())
+	l.clientip = getClientIPAddress(r)
+	l.remoteaddr = r.RemoteAddr
+	r.Body = &countReader{ReadCloser: r.Body, n: &l.reqsize}
 	l.reuse = reuse
+	l.setRequestHeaders(r)
+}
+
+// setRequestHeaders keeps the request line and headers used by the access log formats
+func (l *HttpLogger) setRequestHeaders(r *http.Request) {
+	l.httpver = r.Proto
+	l.host = r.Host
+	l.useragent = r.UserAgent()
+	l.referer = r.Referer()
+	l.traceid = r.Header.Get("X-Amzn-Trace-Id")
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		l.targetaddr = addr.String()
+	}
+	l.headers = getLogHeaders(r.Header)
+	if requestsMax > 0 || captureEnabled() {
+		l.header = r.Header.Clone()
+	}
+}
+
+// countReader counts the bytes read from the wrapped body
+type countReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
 }
 
 func setRespSizeForLogger(respSize int64, r *http.Request) {
@@ -58,7 +121,7 @@ func setStatusForLogger(status int, r *http.Request) {
 func (l *HttpLogger) log() {
 	restime := time.Now()
 	// request logging
-	logger := zerolog.New(os.Stdout).With().
+	zctx := zerolog.New(accessLogWriter).With().
 		Time("reqtime", l.reqtime).
 		Str("proto", l.proto).
 		Str("method", l.method).
@@ -67,42 +130,71 @@ func (l *HttpLogger) log() {
 		Str("clientip", l.clientip).
 		Str("srcip", extractIPAddress(l.remoteaddr)).
 		Int("srcport", extractPort(l.remoteaddr)).
-		Int64("reqsize", l.reqsize).
+		Int64("reqsize", atomic.LoadInt64(&l.reqsize)).
 		Int64("size", l.size).
 		Int("status", l.status).
 		Time("time", restime).
 		Dur("duration", restime.Sub(l.reqtime)).
 		Int64("reuse", l.reuse).
-		Logger()
+		Str("httpver", l.httpver).
+		Str("host", l.host).
+		Str("useragent", l.useragent).
+		Str("referer", l.referer).
+		Str("traceid", l.traceid).
+		Str("targetip", extractIPAddress(l.targetaddr)).
+		Int("targetport", extractPort(l.targetaddr)).
+		Time("conntime", l.timing.conntime).
+		Float64("tlsdur", durationMillis(l.timing.tls)).
+		Float64("headerdur", durationMillis(l.timing.header)).
+		Float64("bodydur", durationMillis(l.timing.body)).
+		Float64("actiondur", durationMillis(l.timing.action)).
+		Float64("writedur", durationMillis(l.timing.write))
+	for _, name := range logHeaders {
+		key := headerFieldKey(name)
+		zctx = zctx.Str(key, l.headers[key])
+	}
+	logger := zctx.Logger()
 	logger.Log().Msg("")
+	recentRequests.add(l.record(restime))
+	l.capture(restime)
+	observeHTTPRequest(l.proto, l.path, l.status, atomic.LoadInt64(&l.reqsize), l.size, restime.Sub(l.reqtime))
 }
 
 func wsLogger(r *http.Request) *zerolog.Logger {
 	proto, _ := r.Context().Value("proto").(string)
 	remotePort := extractPort(r.RemoteAddr)
 	remoteAddr := extractIPAddress(r.RemoteAddr)
-	logger := zerolog.New(os.Stdout).With().
+	logger := zerolog.New(logOutput).With().
 		Time("conntime", time.Now()).
 		Str("proto", proto).
 		Str("clientip", getClientIPAddress(r)).
 		Str("srcip", remoteAddr).
 		Int("srcport", remotePort).
+		Str("traceid", r.Header.Get("X-Amzn-Trace-Id")).
 		Logger()
 	return &logger
 }
 
 type GrpcLogger struct {
-	opentime  time.Time
-	recvtime  time.Time
-	sendtime  time.Time
-	closetime time.Time
-	proto     string
-	mode      string
-	method    string
-	params    string
-	clientip  string
-	srcip     string
-	srcport   int
+	opentime    time.Time
+	recvtime    time.Time
+	sendtime    time.Time
+	closetime   time.Time
+	proto       string
+	mode        string
+	method      string
+	params      string
+	clientip    string
+	srcip       string
+	srcport     int
+	targetip    string
+	targetport  int
+	host        string
+	useragent   string
+	traceid     string
+	headers     map[string]string // -logfields header:Name
+	deadline    time.Duration     // remaining time until the client's deadline when received
+	hasDeadline bool
 }
 
 func initLoggerForUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo) *GrpcLogger {
@@ -118,14 +210,60 @@ func initLoggerForUnary(ctx context.Context, req interface{}, info *grpc.UnarySe
 	if params, ok := req.(*pb.GelboRequest); ok {
 		l.params = params.String()
 	}
+	l.setMDSet(mds)
+	l.setDeadline(ctx)
+	return l
+}
+
+func (l *GrpcLogger) setMDSet(mds *mdSet) {
 	l.clientip = mds.ClientIP
 	l.srcip = mds.SrcIP
 	l.srcport = mds.SrcPort
-	return l
+	l.targetip = mds.TargetIP
+	l.targetport = mds.TargetPort
+	l.host = mds.headers[":authority"]
+	l.useragent = mds.headers["user-agent"]
+	l.traceid = mds.headers["x-amzn-trace-id"]
+	if len(logHeaders) > 0 {
+		l.headers = make(map[string]string, len(logHeaders))
+		for _, name := range logHeaders {
+			key := headerFieldKey(name)
+			l.headers[key] = mds.headers[key]
+		}
+	}
+}
+
+func (l *GrpcLogger) withRequestHeaders(zctx zerolog.Context) zerolog.Context {
+	zctx = zctx.
+		Str("targetip", l.targetip).
+		Int("targetport", l.targetport).
+		Str("host", l.host).
+		Str("useragent", l.useragent).
+		Str("traceid", l.traceid)
+	for _, name := range logHeaders {
+		key := headerFieldKey(name)
+		zctx = zctx.Str(key, l.headers[key])
+	}
+	return zctx
+}
+
+func (l *GrpcLogger) setDeadline(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		l.hasDeadline = true
+		l.deadline = time.Until(deadline)
+	}
+}
+
+// withCtxErr adds the reason (canceled / deadline exceeded) if ctx is done.
+func withCtxErr(e *zerolog.Event, ctx context.Context) *zerolog.Event {
+	if err := ctx.Err(); err != nil {
+		e = e.Str("ctxerr", err.Error())
+	}
+	return e
 }
 
 func (l *GrpcLogger) forUnary() *zerolog.Logger {
-	logger := zerolog.New(os.Stdout).With().
+	zctx := zerolog.New(logOutput).With().
 		Time("recvtime", l.recvtime).
 		Str("proto", l.proto).
 		Str("mode", l.mode).
@@ -133,8 +271,11 @@ func (l *GrpcLogger) forUnary() *zerolog.Logger {
 		Str("params", l.params).
 		Str("clientip", l.clientip).
 		Str("srcip", l.srcip).
-		Int("srcport", l.srcport).
-		Logger()
+		Int("srcport", l.srcport)
+	if l.hasDeadline {
+		zctx = zctx.Dur("deadline", l.deadline)
+	}
+	logger := l.withRequestHeaders(zctx).Logger()
 	return &logger
 }
 
@@ -153,21 +294,23 @@ func initLoggerForStream(ctx context.Context, info *grpc.StreamServerInfo) *Grpc
 		l.mode = "server"
 	}
 	l.method = info.FullMethod
-	l.clientip = mds.ClientIP
-	l.srcip = mds.SrcIP
-	l.srcport = mds.SrcPort
+	l.setMDSet(mds)
+	l.setDeadline(ctx)
 	return l
 }
 
 func (l *GrpcLogger) forStream() *zerolog.Logger {
-	logger := zerolog.New(os.Stdout).With().
+	zctx := zerolog.New(logOutput).With().
 		Time("opentime", l.opentime).
 		Str("proto", l.proto).
 		Str("mode", l.mode).
 		Str("method", l.method).
 		Str("clientip", l.clientip).
 		Str("srcip", l.srcip).
-		Int("srcport", l.srcport).
-		Logger()
+		Int("srcport", l.srcport)
+	if l.hasDeadline {
+		zctx = zctx.Dur("deadline", l.deadline)
+	}
+	logger := l.withRequestHeaders(zctx).Logger()
 	return &logger
 }
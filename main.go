@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -30,6 +32,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/smallstep/certinfo"
 	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -46,6 +49,7 @@ var (
 	cw            ConnectionWatcher
 	httpSrv       *http.Server
 	httpsSrv      *http.Server
+	instanceID    string // identifies this process among gelbo instances
 
 	//go:embed cert/server-cert.pem
 	certData []byte
@@ -53,6 +57,12 @@ var (
 	keyData []byte
 )
 
+func newInstanceID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return fmt.Sprintf("%s-%s", store.host.IP, hex.EncodeToString(b))
+}
+
 // PPWrapListenAndServeProps ... ListenAndServeProps for Proxy Protocol
 type PPWrapListenAndServeProps struct {
 	Srv    *http.Server
@@ -79,6 +89,12 @@ func PPWrapListenAndServe(props *PPWrapListenAndServeProps) error {
 }
 
 func main() {
+	initialize()
+	serve()
+}
+
+// serve starts gelbo with the settings prepared by initialize
+func serve() {
 	// Check if running in Lambda environment
 	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
 		isLambda = true
@@ -110,6 +126,12 @@ func main() {
 		}
 	}
 
+	instanceID = newInstanceID()
+	if err := startTracing(); err != nil {
+		log.Fatalln(err)
+	}
+	go historySampler()
+	startBroadcastBackend(hub)
 	go hub.run()
 	router := http.NewServeMux()
 	if execFlag {
@@ -120,7 +142,16 @@ func main() {
 	router.HandleFunc("/files/", handlerWrapper(filesDLHandler))
 	router.HandleFunc("/chat/", handlerWrapper(filesDLHandler))
 	router.HandleFunc("/ws/", wsHandler)
+	router.HandleFunc("/dashboard/", handlerWrapper(filesDLHandler))
+	router.HandleFunc("/dashboard/ws", dashboardWsHandler)
+	router.HandleFunc(wsBroadcastPath, noLogHandlerWrapper(wsBroadcastHandler))
+	router.HandleFunc("/grpc/", streamHandlerWrapper(grpcTranscodeHandler))
+	router.HandleFunc("/sse/", handlerWrapper(sseHandler))
+	router.HandleFunc("/hold/", handlerWrapper(holdHandler))
 	router.HandleFunc("/monitor/", noLogHandlerWrapper(monitorHandler))
+	router.HandleFunc("/fleet/", noLogHandlerWrapper(fleetHandler))
+	router.HandleFunc("/metrics", noLogHandlerWrapper(metricsHandler()))
+	router.HandleFunc("/requests/", noLogHandlerWrapper(requestsHandler))
 	router.HandleFunc("/", handlerWrapper(defaultHandler))
 	h2cWrapper := &HandlerH2C{
 		Handler:  router,
@@ -132,7 +163,7 @@ func main() {
 		IdleTimeout: time.Duration(idleTimeout) * time.Second,
 		ConnState:   cw.OnStateChange,
 		Handler:     h2cWrapper,
-		TLSConfig:   loadTLSConfig(),
+		TLSConfig:   newTimingTLSConfig(loadTLSConfig()),
 		ErrorLog:    log.New(io.Discard, "", 0),
 	}
 	go func() {
@@ -193,6 +224,14 @@ func (cw *ConnectionWatcher) OnStateChange(conn net.Conn, state http.ConnState)
 			csMaps.del(key)
 		}
 		csMaps.set(key, conn)
+		if cs, ok := csMaps.get(key); ok {
+			proto := "http"
+			if _, ok := conn.(*tls.Conn); ok {
+				proto = "https"
+			}
+			cs.setProto(proto)
+			cs.connEvent("accept").Msg("")
+		}
 		atomic.AddInt64(&cw.total, 1)
 		remoteNodes.addTotalConns(extractIPAddress(remoteAddr), 1)
 		// tcp keepalive setting
@@ -221,6 +260,10 @@ func (cw *ConnectionWatcher) OnStateChange(conn net.Conn, state http.ConnState)
 		return
 	}
 	cs.updateState(state)
+	if state == http.StateIdle {
+		cs.setReady(time.Now())
+	}
+	cs.logHttpConnEvent(state)
 	switch state {
 	case http.StateActive:
 		// active_conns is now counted in handlerWrapper (per-request/stream).
@@ -266,11 +309,15 @@ func (cw *ConnectionWatcher) getActiveConns() int64 {
 func handlerWrapper(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var reuse int64
-		if cs, ok := csMaps.getByRemoteAddr(r.RemoteAddr); ok {
+		cs, ok := csMaps.getByRemoteAddr(r.RemoteAddr)
+		if ok {
 			reuse = atomic.AddInt64(&cs.reuse, 1)
 		}
 		httpLogger, _ := r.Context().Value("logger").(*HttpLogger)
 		httpLogger.init(r, reuse)
+		if ok {
+			httpLogger.setConnTiming(cs, r)
+		}
 
 		// Count active requests per handler invocation.
 		// This works correctly for HTTP/1.1 (1 request at a time per conn) and
@@ -288,6 +335,34 @@ func handlerWrapper(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// streamHandlerWrapper is like handlerWrapper but does not consume the request
+// body before calling fn. Used for endpoints that read the body as a stream.
+func streamHandlerWrapper(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reuse int64
+		cs, ok := csMaps.getByRemoteAddr(r.RemoteAddr)
+		if ok {
+			reuse = atomic.AddInt64(&cs.reuse, 1)
+		}
+		httpLogger, _ := r.Context().Value("logger").(*HttpLogger)
+		httpLogger.initForStream(r, reuse)
+		if ok {
+			httpLogger.setConnTiming(cs, r)
+		}
+
+		remoteIP := extractIPAddress(r.RemoteAddr)
+		atomic.AddInt64(&cw.active, 1)
+		remoteNodes.addActiveConns(remoteIP, 1)
+		defer func() {
+			atomic.AddInt64(&cw.active, -1)
+			remoteNodes.addActiveConns(remoteIP, -1)
+		}()
+
+		fn(w, r)
+		httpLogger.log()
+	}
+}
+
 // noLogHandlerWrapper is like handlerWrapper but suppresses access logging.
 // Used for endpoints like /monitor/ where frequent polling would flood the log.
 func noLogHandlerWrapper(fn http.HandlerFunc) http.HandlerFunc {
@@ -396,6 +471,7 @@ func isSensitiveEnvKey(key string) bool {
 func stopHandler(w http.ResponseWriter, r *http.Request) {
 	_, graceful := r.URL.Query()["graceful"]
 	if !graceful {
+		shutdownTracing(time.Second)
 		log.Fatalf("stop request received")
 	}
 
@@ -410,39 +486,32 @@ func stopHandler(w http.ResponseWriter, r *http.Request) {
 	// calling it from within a handler would deadlock (the handler would wait
 	// for Shutdown, and Shutdown would wait for the handler to return).
 	go func() {
+		// grpcSrv/grpcsSrv are replaced by the grpc* directives. shuttingDown is set under
+		// the lock so that they are not replaced after this (see updateGrpcServers).
+		grpcParamsMu.Lock()
+		shuttingDown.Store(true)
+		grpcSrvs := []*grpc.Server{grpcSrv, grpcsSrv}
+		grpcParamsMu.Unlock()
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
 		var wg sync.WaitGroup
-		if grpcSrv != nil {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				stopped := make(chan struct{})
-				go func() {
-					grpcSrv.GracefulStop()
-					close(stopped)
-				}()
-				select {
-				case <-stopped:
-				case <-ctx.Done():
-					grpcSrv.Stop()
-				}
-			}()
-		}
-		if grpcsSrv != nil {
+		for _, srv := range grpcSrvs {
+			if srv == nil {
+				continue
+			}
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 				stopped := make(chan struct{})
 				go func() {
-					grpcsSrv.GracefulStop()
+					srv.GracefulStop()
 					close(stopped)
 				}()
 				select {
 				case <-stopped:
 				case <-ctx.Done():
-					grpcsSrv.Stop()
+					srv.Stop()
 				}
 			}()
 		}
@@ -461,28 +530,16 @@ func stopHandler(w http.ResponseWriter, r *http.Request) {
 			}()
 		}
 		wg.Wait()
+		shutdownTracing(5 * time.Second)
 
 		log.Fatalf("stop request received (graceful)")
 	}()
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	proto, _ := r.Context().Value("proto").(string)
-	queryStr, _ := url.QueryUnescape(r.URL.Query().Encode())
-	reqHeaders := combineValues(r.Header)
-	reqInfo := RequestInfo{
-		Proto:  proto,
-		Method: r.Method,
-		Path:   r.URL.EscapedPath(),
-		Query:  queryStr,
-		Header: reqHeaders,
-	}
-	// add (decoded) mtls cert text info
-	if mtlsCert := getMtlsCert(reqHeaders); mtlsCert != "" {
-		reqInfo.MtlsCert = decodeMtlsCert(mtlsCert)
-	}
-	reqInfo.Header["Host"] = r.Host
-	reqInfo.setIPAddress(r)
+	ctx, span := startHTTPSpan(r)
+	r = r.WithContext(ctx)
+	reqInfo := newRequestInfo(r)
 	respInfo := ResponseInfo{
 		Host: *store.getHostInfo(),
 		Resource: ResourceInfo{
@@ -503,6 +560,8 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	resultCmds := inputCmds.evaluate()
 	respInfo.Direction.Input = inputCmds
 	respInfo.Direction.Result = resultCmds
+	setDirectionForLogger(respInfo.Direction, r)
+	setDirectionForSpan(ctx, inputCmds, resultCmds)
 
 	reqSize, _ := io.Copy(io.Discard, r.Body)
 	respSize, statusCode := execAction(w, r, &respInfo)
@@ -514,6 +573,27 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
 	setRespSizeForLogger(respSize, r)
 	setStatusForLogger(statusCode, r)
+	endHTTPSpan(span, statusCode, respSize)
+}
+
+func newRequestInfo(r *http.Request) RequestInfo {
+	proto, _ := r.Context().Value("proto").(string)
+	queryStr, _ := url.QueryUnescape(r.URL.Query().Encode())
+	reqHeaders := combineValues(r.Header)
+	reqInfo := RequestInfo{
+		Proto:  proto,
+		Method: r.Method,
+		Path:   r.URL.EscapedPath(),
+		Query:  queryStr,
+		Header: reqHeaders,
+	}
+	// add (decoded) mtls cert text info
+	if mtlsCert := getMtlsCert(reqHeaders); mtlsCert != "" {
+		reqInfo.MtlsCert = decodeMtlsCert(mtlsCert)
+	}
+	reqInfo.Header["Host"] = r.Host
+	reqInfo.setIPAddress(r)
+	return reqInfo
 }
 
 func combineValues(input map[string][]string) map[string]string {
@@ -534,7 +614,9 @@ func execAction(w http.ResponseWriter, r *http.Request, respInfo *ResponseInfo)
 	if respInfo.Direction.Input.needsAction() {
 		if arrayContains(respInfo.Direction.Input.actions, "sleep") {
 			sleep, _ := strconv.Atoi(respInfo.Direction.Result.getValue("sleep"))
+			sleepStart := time.Now()
 			time.Sleep(time.Duration(sleep) * time.Millisecond)
+			setActionTimeForLogger(time.Since(sleepStart), r)
 		}
 		if arrayContains(respInfo.Direction.Input.actions, "status") {
 			statusCode, _ = strconv.Atoi(respInfo.Direction.Result.getValue("status"))
@@ -547,6 +629,7 @@ func execAction(w http.ResponseWriter, r *http.Request, respInfo *ResponseInfo)
 			memory, _ := strconv.ParseFloat(respInfo.Direction.Result.getValue("memory"), 64)
 			store.resource.Memory.setTarget(memory)
 		}
+		applyGrpcParamDirectives(respInfo.Direction.Input, respInfo.Direction.Result)
 		if arrayContains(respInfo.Direction.Input.actions, "size") {
 			size, _ := strconv.Atoi(respInfo.Direction.Result.getValue("size"))
 			respSize = size
@@ -578,6 +661,8 @@ func execAction(w http.ResponseWriter, r *http.Request, respInfo *ResponseInfo)
 	for key, value := range headerMap.getAll() {
 		w.Header().Add(key, value)
 	}
+	setServerTimingHeader(w, r)
+	writeStart := time.Now()
 	w.WriteHeader(statusCode)
 	var err error
 	if chunkFlag && r.Proto == "HTTP/1.1" {
@@ -585,6 +670,7 @@ func execAction(w http.ResponseWriter, r *http.Request, respInfo *ResponseInfo)
 	} else {
 		err = writeResponse(w, respSize, respJSON)
 	}
+	setWriteTimeForLogger(time.Since(writeStart), r)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -603,6 +689,7 @@ func disconnect(remoteAddr string, proto string, force bool) {
 		// then pass the inner conn to closeConnection() so linger/RST can be applied correctly.
 		if tracked, ok := cs.conn.(*grpcTrackedConn); ok {
 			tracked.once.Do(func() {
+				cs.connEvent("close").Str("initiator", initiatorDisconnect).Msg("")
 				atomic.AddInt64(&cw.total, -1)
 				remoteNodes.addTotalConns(extractIPAddress(remoteAddr), -1)
 			})
@@ -611,13 +698,15 @@ func disconnect(remoteAddr string, proto string, force bool) {
 			closeConnection(cs.conn, force)
 		}
 	} else {
+		cs.connEvent("close").Str("initiator", initiatorDisconnect).Msg("")
 		closeConnection(cs.conn, force)
 	}
 	// For h2c, total_conns is managed by HandlerH2C.ServeHTTP around ServeConn:
 	// it is decremented when ServeConn returns after the connection is closed here.
 	// active_conns is managed by handlerWrapper's defer, so no adjustment needed here.
 	if !isGrpc && proto != "h2c" {
-		if cs.curState != http.StateClosed {
+		// total_conns of hijacked connections (websocket) was already decremented by OnStateChange
+		if cs.curState != http.StateClosed && cs.curState != http.StateHijacked {
 			atomic.AddInt64(&cw.total, -1)
 			remoteNodes.addTotalConns(extractIPAddress(remoteAddr), -1)
 		}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the test binary started by startSelftestServer runs as gelbo
+	if os.Getenv(selftestServerEnv) != "" {
+		initialize()
+		serve()
+		return
+	}
+	os.Exit(m.Run())
+}
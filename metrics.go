@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "gelbo"
+
+// metricsPaths are the path labels of http metrics. other paths are labeled "/" to keep the cardinality low.
+var metricsPaths = []string{"/exec/", "/env/", "/files/", "/chat/", "/grpc/", "/sse/", "/hold/", "/dashboard/"}
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "http_requests_total",
+		Help: "Number of http requests by proto, path and status.",
+	}, []string{"proto", "path", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace, Name: "http_request_duration_seconds",
+		Help:    "Latency of http requests by proto, path and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proto", "path", "status"})
+	httpReceivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "http_received_bytes_total",
+		Help: "Bytes of http request bodies by proto and path.",
+	}, []string{"proto", "path"})
+	httpSentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "http_sent_bytes_total",
+		Help: "Bytes of http response bodies by proto and path.",
+	}, []string{"proto", "path"})
+
+	grpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "grpc_calls_total",
+		Help: "Number of finished gRPC calls by proto, method and code.",
+	}, []string{"proto", "method", "code"})
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace, Name: "grpc_call_duration_seconds",
+		Help:    "Latency of gRPC calls (stream lifetime for streaming calls) by proto, method and code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proto", "method", "code"})
+	grpcActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "grpc_active_streams",
+		Help: "Number of open gRPC streams by proto and method.",
+	}, []string{"proto", "method"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		httpRequests, httpDuration, httpReceivedBytes, httpSentBytes,
+		grpcCalls, grpcDuration, grpcActiveStreams,
+		&nodeCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func metricsHandler() http.HandlerFunc {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP
+}
+
+func metricsPath(path string) string {
+	for _, prefix := range metricsPaths {
+		if strings.HasPrefix(path, prefix) {
+			return prefix
+		}
+	}
+	return "/"
+}
+
+func observeHTTPRequest(proto, path string, statusCode int, reqSize, respSize int64, duration time.Duration) {
+	path = metricsPath(path)
+	code := strconv.Itoa(statusCode)
+	httpRequests.WithLabelValues(proto, path, code).Inc()
+	httpDuration.WithLabelValues(proto, path, code).Observe(duration.Seconds())
+	httpReceivedBytes.WithLabelValues(proto, path).Add(float64(reqSize))
+	httpSentBytes.WithLabelValues(proto, path).Add(float64(respSize))
+}
+
+func observeGrpcCall(proto, method string, err error, duration time.Duration) {
+	code := status.Code(err).String()
+	grpcCalls.WithLabelValues(proto, method, code).Inc()
+	grpcDuration.WithLabelValues(proto, method, code).Observe(duration.Seconds())
+}
+
+// nodeCollector exposes the values of /monitor/ at the time of scraping
+type nodeCollector struct{}
+
+var (
+	activeConnsDesc = prometheus.NewDesc(metricsNamespace+"_active_conns",
+		"Number of active connections (requests in progress).", nil, nil)
+	totalConnsDesc = prometheus.NewDesc(metricsNamespace+"_total_conns",
+		"Number of open connections.", nil, nil)
+	remoteActiveConnsDesc = prometheus.NewDesc(metricsNamespace+"_remote_active_conns",
+		"Number of active connections per remote node.", []string{"remote"}, nil)
+	remoteTotalConnsDesc = prometheus.NewDesc(metricsNamespace+"_remote_total_conns",
+		"Number of open connections per remote node.", []string{"remote"}, nil)
+	remoteRequestsDesc = prometheus.NewDesc(metricsNamespace+"_remote_requests_total",
+		"Number of requests per remote node.", []string{"remote"}, nil)
+	cpuUsageDesc = prometheus.NewDesc(metricsNamespace+"_cpu_usage_percent",
+		"CPU usage (target specified by the cpu directive and current).", []string{"type"}, nil)
+	memoryUsageDesc = prometheus.NewDesc(metricsNamespace+"_memory_usage_percent",
+		"Memory usage (target specified by the memory directive and current).", []string{"type"}, nil)
+	wsOpenConnsDesc = prometheus.NewDesc(metricsNamespace+"_websocket_open_conns",
+		"Number of open websocket connections.", nil, nil)
+	wsConnsDesc = prometheus.NewDesc(metricsNamespace+"_websocket_conns_total",
+		"Number of websocket connections.", nil, nil)
+	wsMessagesDesc = prometheus.NewDesc(metricsNamespace+"_websocket_messages_total",
+		"Number of websocket messages by direction.", []string{"direction"}, nil)
+	wsBytesDesc = prometheus.NewDesc(metricsNamespace+"_websocket_bytes_total",
+		"Bytes of websocket messages by direction.", []string{"direction"}, nil)
+	wsClosesDesc = prometheus.NewDesc(metricsNamespace+"_websocket_closes_total",
+		"Number of closed websocket connections by close code.", []string{"code"}, nil)
+)
+
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		activeConnsDesc, totalConnsDesc,
+		remoteActiveConnsDesc, remoteTotalConnsDesc, remoteRequestsDesc,
+		cpuUsageDesc, memoryUsageDesc,
+		wsOpenConnsDesc, wsConnsDesc, wsMessagesDesc, wsBytesDesc, wsClosesDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(activeConnsDesc, prometheus.GaugeValue, float64(cw.getActiveConns()))
+	ch <- prometheus.MustNewConstMetric(totalConnsDesc, prometheus.GaugeValue, float64(cw.getTotalConns()))
+
+	remoteNodes.RLock()
+	for remote, node := range remoteNodes.m {
+		node.RLock()
+		ch <- prometheus.MustNewConstMetric(remoteActiveConnsDesc, prometheus.GaugeValue, float64(node.ActiveConns), remote)
+		ch <- prometheus.MustNewConstMetric(remoteTotalConnsDesc, prometheus.GaugeValue, float64(node.TotalConns), remote)
+		ch <- prometheus.MustNewConstMetric(remoteRequestsDesc, prometheus.CounterValue, float64(node.RequestCount), remote)
+		node.RUnlock()
+	}
+	remoteNodes.RUnlock()
+
+	for desc, usage := range map[*prometheus.Desc]*ResourceUsage{cpuUsageDesc: &store.resource.CPU, memoryUsageDesc: &store.resource.Memory} {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, usage.getTarget(), "target")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, usage.getCurrent(), "current")
+	}
+
+	store.node.RLock()
+	ws := store.node.WebSocket
+	store.node.RUnlock()
+	if ws == nil {
+		return
+	}
+	ws.Lock()
+	defer ws.Unlock()
+	ch <- prometheus.MustNewConstMetric(wsOpenConnsDesc, prometheus.GaugeValue, float64(ws.OpenConns))
+	ch <- prometheus.MustNewConstMetric(wsConnsDesc, prometheus.CounterValue, float64(ws.TotalConns))
+	ch <- prometheus.MustNewConstMetric(wsMessagesDesc, prometheus.CounterValue, float64(ws.MessagesIn), "in")
+	ch <- prometheus.MustNewConstMetric(wsMessagesDesc, prometheus.CounterValue, float64(ws.MessagesOut), "out")
+	ch <- prometheus.MustNewConstMetric(wsBytesDesc, prometheus.CounterValue, float64(ws.ReceivedBytes), "in")
+	ch <- prometheus.MustNewConstMetric(wsBytesDesc, prometheus.CounterValue, float64(ws.SentBytes), "out")
+	for code, count := range ws.CloseCodes {
+		ch <- prometheus.MustNewConstMetric(wsClosesDesc, prometheus.CounterValue, float64(count), code)
+	}
+}
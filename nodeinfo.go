@@ -28,6 +28,8 @@ type NodeInfo struct {
 	ActiveConns int64   `json:"active_conns"`
 	TotalConns  int64   `json:"total_conns"`
 
+	WebSocket *WebSocketStats `json:"websocket,omitempty"`
+
 	ELBs map[string]*NodeInfo `json:"elbs,omitempty"`
 }
 
@@ -85,6 +87,111 @@ func (ni *NodeInfo) addActiveConns(cnt int64) {
 	ni.ActiveConns += cnt
 }
 
+// resetCounters clears the cumulative counters. connection counts are kept since they are current values.
+func (ni *NodeInfo) resetCounters() {
+	ni.Lock()
+	defer ni.Unlock()
+	now := time.Now().UnixNano()
+	ni.CreatedAt = now
+	ni.UpdatedAt = now
+	ni.RequestCount = 0
+	ni.SentBytes = 0
+	ni.ReceivedBytes = 0
+	if ni.WebSocket != nil {
+		ni.WebSocket.reset()
+	}
+}
+
+// getWebSocketStats returns the websocket statistics (created on the first websocket connection)
+func (ni *NodeInfo) getWebSocketStats() *WebSocketStats {
+	ni.Lock()
+	defer ni.Unlock()
+	ni.UpdatedAt = time.Now().UnixNano()
+	if ni.WebSocket == nil {
+		ni.WebSocket = &WebSocketStats{
+			Mutex:      &sync.Mutex{},
+			CloseCodes: make(map[string]int64),
+		}
+	}
+	return ni.WebSocket
+}
+
+// WebSocketStats ... statistics of websocket connections
+type WebSocketStats struct {
+	*sync.Mutex
+	OpenConns     int64            `json:"open_conns"`
+	TotalConns    int64            `json:"total_conns"`
+	MessagesIn    int64            `json:"messages_in"`
+	MessagesOut   int64            `json:"messages_out"`
+	ReceivedBytes int64            `json:"received_bytes"`
+	SentBytes     int64            `json:"sent_bytes"`
+	Pings         int64            `json:"pings"`
+	Pongs         int64            `json:"pongs"`
+	RTTLast       float64          `json:"rtt_last_ms"`
+	RTTAvg        float64          `json:"rtt_avg_ms"`
+	RTTMax        float64          `json:"rtt_max_ms"`
+	CloseCodes    map[string]int64 `json:"close_codes"`
+}
+
+// MarshalJSON locks the stats since they are updated by the websocket goroutines
+func (ws *WebSocketStats) MarshalJSON() ([]byte, error) {
+	ws.Lock()
+	defer ws.Unlock()
+	type stats WebSocketStats
+	return json.Marshal((*stats)(ws))
+}
+
+// reset clears the counters. open connections are counted again in total_conns.
+func (ws *WebSocketStats) reset() {
+	ws.Lock()
+	defer ws.Unlock()
+	*ws = WebSocketStats{
+		Mutex:      ws.Mutex,
+		OpenConns:  ws.OpenConns,
+		TotalConns: ws.OpenConns,
+		CloseCodes: make(map[string]int64),
+	}
+}
+
+func (ws *WebSocketStats) reflectOpen() {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.OpenConns++
+	ws.TotalConns++
+}
+func (ws *WebSocketStats) reflectClose(code string) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.OpenConns--
+	ws.CloseCodes[code]++
+}
+func (ws *WebSocketStats) reflectRead(size int) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.MessagesIn++
+	ws.ReceivedBytes += int64(size)
+}
+func (ws *WebSocketStats) reflectWrite(size int) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.MessagesOut++
+	ws.SentBytes += int64(size)
+}
+func (ws *WebSocketStats) reflectPing() {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.Pings++
+}
+func (ws *WebSocketStats) reflectPong(rtt time.Duration) {
+	ws.Lock()
+	defer ws.Unlock()
+	ms := float64(rtt.Microseconds()) / 1000
+	ws.RTTAvg = (ws.RTTAvg*float64(ws.Pongs) + ms) / float64(ws.Pongs+1)
+	ws.RTTLast = ms
+	ws.RTTMax = math.Max(ws.RTTMax, ms)
+	ws.Pongs++
+}
+
 func monitorHandler(w http.ResponseWriter, r *http.Request) {
 	var rawFlag bool
 	qsMap := r.URL.Query()
@@ -94,6 +201,24 @@ func monitorHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
+	switch r.URL.Path {
+	case "/monitor/reset":
+		resetHandler(w, r, rawFlag)
+		return
+	case "/monitor/snapshot":
+		snapshotHandler(w, r, rawFlag)
+		return
+	case "/monitor/snapshots":
+		writeMonitorJSON(w, snapshots.list(), rawFlag)
+		return
+	case "/monitor/diff":
+		diffHandler(w, r, rawFlag)
+		return
+	}
+	if qsMap.Has("history") {
+		historyHandler(w, r, rawFlag)
+		return
+	}
 	updateNode()
 	if rawFlag {
 		fmt.Fprintf(w, "\n%s\n", getStoreNodeJSON())
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	v3orcapb "github.com/cncf/xds/go/xds/data/orca/v3"
+	v3orcaservice "github.com/cncf/xds/go/xds/service/orca/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/orca"
+	"google.golang.org/grpc/status"
+)
+
+const orcaUpdateInterval = 1000
+
+var (
+	orcaFlag        bool
+	orcaMinInterval int
+	orcaMetrics     = orca.NewServerMetricsRecorder()
+	grpcCallCount   int64
+	grpcErrorCount  int64
+)
+
+// orcaServerOptions returns the interceptors that attach per-call load reports
+// (endpoint-load-metrics-bin trailer) to every gRPC response.
+func orcaServerOptions() []grpc.ServerOption {
+	if !orcaFlag {
+		return []grpc.ServerOption{}
+	}
+	return []grpc.ServerOption{
+		orca.CallMetricsServerOption(orcaMetrics),
+		grpc.ChainUnaryInterceptor(orcaUnaryInterceptor),
+		grpc.ChainStreamInterceptor(orcaStreamInterceptor),
+	}
+}
+
+// registerOrcaService registers the OOB load reporting service (xds.service.orca.v3.OpenRcaService).
+func registerOrcaService(srv *grpc.Server) {
+	if orcaFlag {
+		v3orcaservice.RegisterOpenRcaServiceServer(srv, &orcaServer{})
+	}
+}
+
+func orcaUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	recordCallMetrics(ctx, start, err)
+	return resp, err
+}
+
+func orcaStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	if info.FullMethod != v3orcaservice.OpenRcaService_StreamCoreMetrics_FullMethodName {
+		recordCallMetrics(ss.Context(), start, err)
+	}
+	return err
+}
+
+// recordCallMetrics counts the call for the request rates and sets the per-call load report.
+// Server metrics (rps, eps) are merged into it by the orca interceptor.
+func recordCallMetrics(ctx context.Context, start time.Time, err error) {
+	atomic.AddInt64(&grpcCallCount, 1)
+	if status.Code(err) != 0 { // 0 = codes.OK
+		atomic.AddInt64(&grpcErrorCount, 1)
+	}
+	if recorder := orca.CallMetricsRecorderFromContext(ctx); recorder != nil {
+		recorder.SetCPUUtilization(store.resource.CPU.getCurrent() / 100)
+		recorder.SetMemoryUtilization(store.resource.Memory.getCurrent() / 100)
+		recorder.SetRequestCost("duration_ms", float64(time.Since(start).Milliseconds()))
+	}
+}
+
+// orcaUpdater periodically updates the server metrics from the current cpu/memory usage and request rates
+func orcaUpdater() {
+	t := time.NewTicker(time.Duration(orcaUpdateInterval) * time.Millisecond)
+	defer t.Stop()
+	prevTime := time.Now()
+	var prevCalls, prevErrors int64
+	for now := range t.C {
+		calls := atomic.LoadInt64(&grpcCallCount)
+		errs := atomic.LoadInt64(&grpcErrorCount)
+		elapsed := now.Sub(prevTime).Seconds()
+		orcaMetrics.SetCPUUtilization(store.resource.CPU.getCurrent() / 100)
+		orcaMetrics.SetMemoryUtilization(store.resource.Memory.getCurrent() / 100)
+		orcaMetrics.SetQPS(float64(calls-prevCalls) / elapsed)
+		orcaMetrics.SetEPS(float64(errs-prevErrors) / elapsed)
+		prevTime, prevCalls, prevErrors = now, calls, errs
+	}
+}
+
+func orcaLoadReport() *v3orcapb.OrcaLoadReport {
+	sm := orcaMetrics.ServerMetrics()
+	report := &v3orcapb.OrcaLoadReport{Utilization: sm.Utilization}
+	if sm.CPUUtilization != -1 { // -1 = unset
+		report.CpuUtilization = sm.CPUUtilization
+	}
+	if sm.MemUtilization != -1 {
+		report.MemUtilization = sm.MemUtilization
+	}
+	if sm.QPS != -1 {
+		report.RpsFractional = sm.QPS
+	}
+	if sm.EPS != -1 {
+		report.Eps = sm.EPS
+	}
+	return report
+}
+
+// orcaServer implements OpenRcaService. Unlike orca.Register (min 30 seconds),
+// the reporting interval can be lowered to -orcainterval to observe quick reactions of clients.
+type orcaServer struct {
+	v3orcaservice.UnimplementedOpenRcaServiceServer
+}
+
+func (s *orcaServer) StreamCoreMetrics(req *v3orcaservice.OrcaLoadReportRequest, stream v3orcaservice.OpenRcaService_StreamCoreMetricsServer) error {
+	interval := req.GetReportInterval().AsDuration()
+	if minInterval := time.Duration(orcaMinInterval) * time.Second; interval < minInterval {
+		interval = minInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := stream.Send(orcaLoadReport()); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are not forwarded to the target (RFC 7230 6.1)
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// runSubcommand runs the subcommand given after the flags and exits with its status
+func runSubcommand(name string, args []string) {
+	switch name {
+	case "replay":
+		os.Exit(runReplay(args))
+	case "load":
+		os.Exit(runLoad(args))
+	case "selftest":
+		os.Exit(runSelftest(args))
+	default:
+		fmt.Printf("unknown subcommand \"%s\"\n", name)
+		os.Exit(2)
+	}
+}
+
+// ClientStats ... the results of the requests sent by gelbo as a client with exclusive control
+type ClientStats struct {
+	*sync.Mutex
+	start     time.Time
+	total     int
+	errors    int
+	status    map[string]int
+	latencies []time.Duration
+}
+
+// ClientSummary ... the summary of ClientStats
+type ClientSummary struct {
+	Total   int            `json:"total"`
+	Errors  int            `json:"errors"`
+	Status  map[string]int `json:"status"`
+	Latency LatencySummary `json:"latency"`           // millisecond
+	Elapsed float64        `json:"elapsed"`           // second
+	Rate    float64        `json:"rate"`              // requests per second
+	Skipped int            `json:"skipped,omitempty"` // requests not replayable, e.g. truncated body (replay)
+}
+
+// LatencySummary ... the latency distribution in milliseconds
+type LatencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func newClientStats() *ClientStats {
+	return &ClientStats{Mutex: &sync.Mutex{}, start: time.Now(), status: map[string]int{}}
+}
+
+// add records a result. empty status means the request failed without a response,
+// and failed means the response is an error (e.g. 5xx for load).
+func (s *ClientStats) add(status string, failed bool, latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.total++
+	if status == "" || failed {
+		s.errors++
+	}
+	if status == "" {
+		return
+	}
+	s.status[status]++
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *ClientStats) summary() ClientSummary {
+	s.Lock()
+	defer s.Unlock()
+	elapsed := time.Since(s.start)
+	summary := ClientSummary{
+		Total:   s.total,
+		Errors:  s.errors,
+		Status:  s.status,
+		Latency: summarizeLatencies(s.latencies),
+		Elapsed: math.Round(elapsed.Seconds()*1000) / 1000,
+	}
+	if elapsed > 0 {
+		summary.Rate = math.Round(float64(s.total)/elapsed.Seconds()*100) / 100
+	}
+	return summary
+}
+
+func summarizeLatencies(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, l := range sorted {
+		sum += l
+	}
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return durationMillis(sorted[i])
+	}
+	return LatencySummary{
+		Min:  durationMillis(sorted[0]),
+		Mean: durationMillis(sum / time.Duration(len(sorted))),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P99:  percentile(99),
+		Max:  durationMillis(sorted[len(sorted)-1]),
+	}
+}
+
+// newClientTransport returns the transport used by the subcommands sending requests
+func newClientTransport(insecure bool, maxConns int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure}
+	transport.MaxIdleConnsPerHost = maxConns
+	transport.MaxIdleConns = maxConns
+	return transport
+}
+
+// ReplayResult ... the result of a replayed request (-v)
+type ReplayResult struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Status   int       `json:"status"`
+	Captured int       `json:"captured_status"`
+	Duration float64   `json:"duration"` // millisecond
+	Size     int64     `json:"size"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// replayOptions ... the options of the replay subcommand
+type replayOptions struct {
+	target       *url.URL
+	speed        float64
+	keepHost     bool
+	stripHeaders []string
+	verbose      bool
+}
+
+// runReplay replays the requests captured by -capture against the target and prints the summary
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	file := fs.String("file", "", "capture file (JSONL) written by -capture (required)")
+	target := fs.String("target", "", "base URL the requests are sent to, e.g. http://localhost:8080 (required)")
+	speed := fs.Float64("speed", 1.0, "timing scale. 2 replays twice as fast as captured. if 0 is specified, requests are sent without waiting")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each request")
+	insecure := fs.Bool("insecure", false, "skip verifying the certificate of the target")
+	keepHost := fs.Bool("keephost", false, "send the captured Host header instead of the host of -target")
+	stripHeaders := fs.String("stripheaders", "X-Forwarded-For,X-Forwarded-Proto,X-Forwarded-Port,X-Amzn-Trace-Id", "comma separated headers not replayed")
+	maxInflight := fs.Int("maxinflight", 100, "maximum number of concurrent requests")
+	verbose := fs.Bool("v", false, "print the result of each request (JSONL)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" || *target == "" {
+		fmt.Println("flag -file and -target are required")
+		return 2
+	}
+	targetURL, err := url.Parse(*target)
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		fmt.Printf("invalid value \"%s\" for flag -target: not http(s) URL\n", *target)
+		return 2
+	}
+	if *speed < 0 {
+		fmt.Printf("invalid value \"%v\" for flag -speed: less than zero\n", *speed)
+		return 2
+	}
+	if *maxInflight <= 0 {
+		fmt.Printf("invalid value \"%d\" for flag -maxinflight: zero or less\n", *maxInflight)
+		return 2
+	}
+	requests, err := loadCapturedRequests(*file)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	opts := &replayOptions{
+		target:       targetURL,
+		speed:        *speed,
+		keepHost:     *keepHost,
+		stripHeaders: splitAndTrim(*stripHeaders),
+		verbose:      *verbose,
+	}
+	client := &http.Client{
+		Transport: newClientTransport(*insecure, *maxInflight),
+		Timeout:   *timeout,
+		// the captured responses are compared as is
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	summary := replay(client, requests, opts, *maxInflight)
+	summaryJSON, _ := jsonMarshalIndent(summary)
+	fmt.Println(string(summaryJSON))
+	if summary.Errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadCapturedRequests reads the capture file and returns the requests in the received order
+func loadCapturedRequests(name string) ([]*CapturedRequest, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	requests := []*CapturedRequest{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), math.MaxInt32)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		req := &CapturedRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].Time < requests[j].Time })
+	return requests, nil
+}
+
+// replay sends the requests keeping the captured intervals scaled by speed
+func replay(client *http.Client, requests []*CapturedRequest, opts *replayOptions, maxInflight int) ClientSummary {
+	stats := newClientStats()
+	encoder := json.NewEncoder(os.Stdout)
+	outMu := &sync.Mutex{}
+	sem := make(chan struct{}, maxInflight)
+	wg := &sync.WaitGroup{}
+	skipped := 0
+	for _, captured := range requests {
+		if opts.speed > 0 {
+			offset := time.Duration(float64(captured.Time-requests[0].Time) / opts.speed)
+			time.Sleep(time.Until(stats.start.Add(offset)))
+		}
+		req, err := newReplayRequest(captured, opts)
+		if err != nil {
+			skipped++
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(captured *CapturedRequest, req *http.Request) {
+			defer func() { <-sem; wg.Done() }()
+			result := sendReplayRequest(client, req)
+			result.Captured = captured.Status
+			status := ""
+			if result.Status != 0 {
+				status = strconv.Itoa(result.Status)
+			}
+			stats.add(status, false, time.Duration(result.Duration*float64(time.Millisecond)))
+			if opts.verbose {
+				outMu.Lock()
+				encoder.Encode(result)
+				outMu.Unlock()
+			}
+		}(captured, req)
+	}
+	wg.Wait()
+	summary := stats.summary()
+	summary.Skipped = skipped
+	return summary
+}
+
+// newReplayRequest builds the request to the target from the captured request
+func newReplayRequest(captured *CapturedRequest, opts *replayOptions) (*http.Request, error) {
+	// the request would differ from the captured one
+	if captured.BodySize > int64(len(captured.Body)) {
+		return nil, fmt.Errorf("body truncated at capture (%d of %d bytes)", len(captured.Body), captured.BodySize)
+	}
+	// the captured path is escaped as received
+	target := opts.target.Scheme + "://" + opts.target.Host + strings.TrimSuffix(opts.target.EscapedPath(), "/") + captured.Path
+	if captured.Query != "" {
+		target += "?" + captured.Query
+	}
+	req, err := http.NewRequest(captured.Method, target, bytes.NewReader(captured.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header(captured.Headers).Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, name := range append(hopHeaders, opts.stripHeaders...) {
+		req.Header.Del(name)
+	}
+	// the length is set from the body
+	req.Header.Del("Content-Length")
+	if opts.keepHost && captured.Host != "" {
+		req.Host = captured.Host
+	}
+	return req, nil
+}
+
+func sendReplayRequest(client *http.Client, req *http.Request) *ReplayResult {
+	result := &ReplayResult{Time: time.Now(), Method: req.Method, URL: req.URL.String()}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Duration = durationMillis(time.Since(result.Time))
+		result.Error = err.Error()
+		return result
+	}
+	result.Size, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.Duration = durationMillis(time.Since(result.Time))
+	result.Status = resp.StatusCode
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSummarizeLatencies(t *testing.T) {
+	latencies := []time.Duration{}
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	got := summarizeLatencies(latencies)
+	want := LatencySummary{Min: 1, Mean: 50.5, P50: 50, P90: 90, P99: 99, Max: 100}
+	if got != want {
+		t.Errorf("summarizeLatencies() = %+v, want %+v", got, want)
+	}
+	if got := summarizeLatencies(nil); got != (LatencySummary{}) {
+		t.Errorf("summarizeLatencies(nil) = %+v", got)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	stats := newClientStats()
+	stats.add("200", false, time.Millisecond)
+	stats.add("503", true, time.Millisecond)
+	stats.add("", false, 0)
+	summary := stats.summary()
+	if summary.Total != 3 || summary.Errors != 2 || summary.Status["200"] != 1 || summary.Status["503"] != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestNewReplayRequest(t *testing.T) {
+	target, _ := url.Parse("https://example.com/base/")
+	captured := &CapturedRequest{
+		Method: http.MethodPost,
+		Host:   "gelbo.internal",
+		Path:   "/a%2Fb",
+		Query:  "sleep=100",
+		Headers: map[string][]string{
+			"Connection":      {"keep-alive"},
+			"Content-Length":  {"100"},
+			"X-Forwarded-For": {"198.51.100.1"},
+			"X-Test":          {"on"},
+		},
+		Body:     []byte("body"),
+		BodySize: 4,
+	}
+	opts := &replayOptions{target: target, stripHeaders: []string{"X-Forwarded-For"}}
+	req, err := newReplayRequest(captured, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.String() != "https://example.com/base/a%2Fb?sleep=100" {
+		t.Errorf("url = %s", req.URL)
+	}
+	if req.Host != "example.com" {
+		t.Errorf("host = %s", req.Host)
+	}
+	for _, name := range []string{"Connection", "Content-Length", "X-Forwarded-For"} {
+		if req.Header.Get(name) != "" {
+			t.Errorf("%s is replayed", name)
+		}
+	}
+	if req.Header.Get("X-Test") != "on" {
+		t.Errorf("X-Test is not replayed")
+	}
+	opts.keepHost = true
+	if req, _ = newReplayRequest(captured, opts); req.Host != "gelbo.internal" {
+		t.Errorf("host = %s with keephost", req.Host)
+	}
+	captured.BodySize = 100
+	if _, err := newReplayRequest(captured, opts); err == nil {
+		t.Errorf("body truncated at capture is replayed")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	requestsDefaultLimit    = 100
+	requestsStreamBuffer    = 256
+	requestsStreamKeepAlive = 15 * time.Second
+)
+
+var (
+	requestsMax        int
+	recentRequests     = NewRequestStore()
+	regexpStatusFilter = regexp.MustCompile(`^[1-5]([0-9]{2}|xx|XX)$`)
+)
+
+// RequestRecord ... a request received by gelbo (HTTP request, gRPC call or WebSocket upgrade)
+type RequestRecord struct {
+	ID            int64               `json:"id"`
+	ReceivedAt    int64               `json:"received_at"`
+	RespondedAt   int64               `json:"responded_at"`
+	Duration      float64             `json:"duration"` // millisecond
+	Proto         string              `json:"proto"`
+	Method        string              `json:"method"`
+	Path          string              `json:"path"`
+	Query         string              `json:"query,omitempty"`
+	Status        int                 `json:"status"`
+	Code          *int32              `json:"code,omitempty"` // gRPC status code
+	Error         string              `json:"error,omitempty"`
+	ClientIP      string              `json:"clientip"`
+	SrcIP         string              `json:"srcip"`
+	SrcPort       int                 `json:"srcport"`
+	ReceivedBytes int64               `json:"received_bytes"`
+	SentBytes     int64               `json:"sent_bytes"`
+	Headers       map[string][]string `json:"headers"`
+	Direction     *Direction          `json:"direction,omitempty"`
+	Timing        *RecordTiming       `json:"timing,omitempty"`
+}
+
+// RecordTiming ... timing breakdown of a HTTP request (millisecond)
+type RecordTiming struct {
+	TLS    float64 `json:"tls"`
+	Header float64 `json:"header"`
+	Body   float64 `json:"body"`
+	Action float64 `json:"action"`
+	Write  float64 `json:"write"`
+}
+
+// RequestStore ... the recent requests with exclusive control
+type RequestStore struct {
+	*sync.RWMutex
+	records     []*RequestRecord
+	lastID      int64
+	subscribers map[chan *RequestRecord]struct{}
+}
+
+// NewRequestStore ... create RequestStore instance
+func NewRequestStore() *RequestStore {
+	return &RequestStore{RWMutex: &sync.RWMutex{}, subscribers: map[chan *RequestRecord]struct{}{}}
+}
+
+// add keeps rec (up to -requestsmax) and sends it to the subscribers. slow subscribers miss records.
+func (rs *RequestStore) add(rec *RequestRecord) {
+	if requestsMax == 0 {
+		return
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	rs.lastID++
+	rec.ID = rs.lastID
+	rs.records = append(rs.records, rec)
+	if len(rs.records) > requestsMax {
+		rs.records = rs.records[len(rs.records)-requestsMax:]
+	}
+	for ch := range rs.subscribers {
+		select {
+		case ch <- rec:
+		default:
+		}
+	}
+}
+
+// find returns the records matching filter from the newest
+func (rs *RequestStore) find(filter *RequestFilter) []*RequestRecord {
+	rs.RLock()
+	defer rs.RUnlock()
+	found := []*RequestRecord{}
+	for i := len(rs.records) - 1; i >= 0 && len(found) < filter.Limit; i-- {
+		if filter.match(rs.records[i]) {
+			found = append(found, rs.records[i])
+		}
+	}
+	return found
+}
+
+func (rs *RequestStore) subscribe() chan *RequestRecord {
+	ch := make(chan *RequestRecord, requestsStreamBuffer)
+	rs.Lock()
+	defer rs.Unlock()
+	rs.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (rs *RequestStore) unsubscribe(ch chan *RequestRecord) {
+	rs.Lock()
+	defer rs.Unlock()
+	delete(rs.subscribers, ch)
+}
+
+// RequestFilter ... conditions of /requests/
+type RequestFilter struct {
+	Path     string     // prefix
+	Status   string     // status code (e.g. 404) or class (e.g. 5xx)
+	ClientIP *net.IPNet // IP address or CIDR
+	Proto    string
+	Since    time.Time
+	Limit    int
+}
+
+func parseRequestFilter(r *http.Request) (*RequestFilter, error) {
+	qsMap := r.URL.Query()
+	filter := &RequestFilter{Path: qsMap.Get("path"), Proto: qsMap.Get("proto"), Limit: requestsDefaultLimit}
+	if status := qsMap.Get("status"); status != "" {
+		if !regexpStatusFilter.MatchString(status) {
+			return nil, fmt.Errorf("invalid status: %s", status)
+		}
+		filter.Status = strings.ToLower(status)
+	}
+	if clientIP := qsMap.Get("clientip"); clientIP != "" {
+		if !strings.Contains(clientIP, "/") {
+			if ip := net.ParseIP(clientIP); ip != nil && ip.To4() != nil {
+				clientIP += "/32"
+			} else {
+				clientIP += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(clientIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clientip: %s", qsMap.Get("clientip"))
+		}
+		filter.ClientIP = ipNet
+	}
+	if since := qsMap.Get("since"); since != "" {
+		// RFC3339 time or duration before now (e.g. 5m)
+		if t, err := time.Parse(time.RFC3339Nano, since); err == nil {
+			filter.Since = t
+		} else if d, err := time.ParseDuration(since); err == nil && d > 0 {
+			filter.Since = time.Now().Add(-d)
+		} else {
+			return nil, fmt.Errorf("invalid since: %s", since)
+		}
+	}
+	if limit := qsMap.Get("limit"); limit != "" {
+		num, err := strconv.Atoi(limit)
+		if err != nil || num <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", limit)
+		}
+		filter.Limit = num
+	}
+	return filter, nil
+}
+
+func (f *RequestFilter) match(rec *RequestRecord) bool {
+	if f.Path != "" && !strings.HasPrefix(rec.Path, f.Path) {
+		return false
+	}
+	if f.Proto != "" && rec.Proto != f.Proto {
+		return false
+	}
+	if f.Status != "" {
+		status := strconv.Itoa(rec.Status)
+		if strings.HasSuffix(f.Status, "xx") {
+			if !strings.HasPrefix(status, f.Status[:1]) {
+				return false
+			}
+		} else if status != f.Status {
+			return false
+		}
+	}
+	if f.ClientIP != nil {
+		if ip := net.ParseIP(rec.ClientIP); ip == nil || !f.ClientIP.Contains(ip) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && rec.ReceivedAt < f.Since.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// requestsHandler serves /requests/ (the recent requests matching the filter) and /requests/?stream
+// (Server-Sent Events of the requests matching the filter from now)
+func requestsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseRequestFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qsMap := r.URL.Query()
+	if !qsMap.Has("stream") {
+		requests := recentRequests.find(filter)
+		writeMonitorJSON(w, map[string]interface{}{"count": len(requests), "requests": requests}, qsMap.Has("raw"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := recentRequests.subscribe()
+	defer recentRequests.unsubscribe(ch)
+	keepAlive := time.NewTicker(requestsStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case rec := <-ch:
+			if !filter.match(rec) {
+				continue
+			}
+			data, _ := json.Marshal(rec)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: request\ndata: %s\n\n", rec.ID, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			// comment line to keep the connection through the idle timeout of proxies
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// record returns the RequestRecord of the HTTP request
+func (l *HttpLogger) record(restime time.Time) *RequestRecord {
+	return &RequestRecord{
+		ReceivedAt:    l.reqtime.UnixNano(),
+		RespondedAt:   restime.UnixNano(),
+		Duration:      durationMillis(restime.Sub(l.reqtime)),
+		Proto:         l.proto,
+		Method:        l.method,
+		Path:          l.path,
+		Query:         l.qstr,
+		Status:        l.status,
+		ClientIP:      l.clientip,
+		SrcIP:         extractIPAddress(l.remoteaddr),
+		SrcPort:       extractPort(l.remoteaddr),
+		ReceivedBytes: l.reqsize,
+		SentBytes:     l.size,
+		Headers:       l.header,
+		Direction:     l.direction,
+		Timing: &RecordTiming{
+			TLS:    durationMillis(l.timing.tls),
+			Header: durationMillis(l.timing.header),
+			Body:   durationMillis(l.timing.body),
+			Action: durationMillis(l.timing.action),
+			Write:  durationMillis(l.timing.write),
+		},
+	}
+}
+
+func setDirectionForLogger(direction Direction, r *http.Request) {
+	if logger, ok := r.Context().Value("logger").(*HttpLogger); ok {
+		logger.direction = &direction
+	}
+}
+
+// grpcRecordHolder keeps the directives of a gRPC call for its RequestRecord
+type grpcRecordHolder struct {
+	mu        sync.Mutex
+	direction *Direction
+}
+
+// withGrpcRecordHolder returns ctx with the holder set by the handler of the call (setDirectionForGrpcRecord)
+func withGrpcRecordHolder(ctx context.Context) (context.Context, *grpcRecordHolder) {
+	holder := &grpcRecordHolder{}
+	return context.WithValue(ctx, "record", holder), holder
+}
+
+// setDirectionForGrpcRecord keeps the directives of the call (the last message of streams)
+func setDirectionForGrpcRecord(ctx context.Context, input, result *Commands) {
+	if holder, ok := ctx.Value("record").(*grpcRecordHolder); ok {
+		holder.mu.Lock()
+		defer holder.mu.Unlock()
+		holder.direction = &Direction{Input: input, Result: result}
+	}
+}
+
+// record returns the RequestRecord of the gRPC call
+func (l *GrpcLogger) record(ctx context.Context, holder *grpcRecordHolder, start time.Time, reqsize, size int64, err error) *RequestRecord {
+	restime := time.Now()
+	var code int32 // 0 = codes.OK
+	errStr := ""
+	if err != nil {
+		code = grpcCode(err)
+		errStr = err.Error()
+	}
+	rec := &RequestRecord{
+		ReceivedAt:    start.UnixNano(),
+		RespondedAt:   restime.UnixNano(),
+		Duration:      durationMillis(restime.Sub(start)),
+		Proto:         l.proto,
+		Method:        http.MethodPost,
+		Path:          l.method,
+		Status:        http.StatusOK,
+		Code:          &code,
+		Error:         errStr,
+		ClientIP:      l.clientip,
+		SrcIP:         l.srcip,
+		SrcPort:       l.srcport,
+		ReceivedBytes: reqsize,
+		SentBytes:     size,
+		Headers:       getGrpcHeaders(ctx),
+	}
+	holder.mu.Lock()
+	rec.Direction = holder.direction
+	holder.mu.Unlock()
+	return rec
+}
+
+// grpcCode returns the status code of err (2 = codes.Unknown if err is not a status error)
+func grpcCode(err error) int32 {
+	if stat, ok := status.FromError(err); ok {
+		return stat.Proto().Code
+	}
+	return 2
+}
+
+// getGrpcHeaders returns the metadata of the gRPC call
+func getGrpcHeaders(ctx context.Context) map[string][]string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return map[string][]string{}
+	}
+	return md.Copy()
+}
+
+// recordWsUpgrade records the WebSocket upgrade request
+func recordWsUpgrade(r *http.Request, reqtime time.Time) {
+	proto, _ := r.Context().Value("proto").(string)
+	restime := time.Now()
+	recentRequests.add(&RequestRecord{
+		ReceivedAt:  reqtime.UnixNano(),
+		RespondedAt: restime.UnixNano(),
+		Duration:    durationMillis(restime.Sub(reqtime)),
+		Proto:       proto,
+		Method:      r.Method,
+		Path:        r.URL.EscapedPath(),
+		Query:       r.URL.RawQuery,
+		Status:      http.StatusSwitchingProtocols,
+		ClientIP:    getClientIPAddress(r),
+		SrcIP:       extractIPAddress(r.RemoteAddr),
+		SrcPort:     extractPort(r.RemoteAddr),
+		Headers:     r.Header.Clone(),
+	})
+}
@@ -0,0 +1,1471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pb "github.com/miyaz/gelbo/grpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// selftestServerEnv is set in the environment of the gelbo started by selftest.
+	// the test binary runs as gelbo when it is set (see TestMain)
+	selftestServerEnv = "GELBO_SELFTEST_SERVER"
+	selftestTimeout   = 10 * time.Second
+	// the grpc server parameters gelbo starts with (restored after the checks changing them)
+	selftestGrpcDefaults = "grpcping=30&grpcpingtimeout=20&grpcmaxidle=0&grpcmaxage=0&grpcmaxagegrace=0&grpcminpingtime=300&grpcmaxstreams=0&grpcwindow=0&grpcconnwindow=0"
+	// X-Forwarded-For sent by the checks of the if directives
+	selftestXFF = "198.51.100.1, 198.51.100.2, 198.51.100.3, 198.51.100.4"
+)
+
+// selftestEnv ... the gelbo under test started on ephemeral ports
+type selftestEnv struct {
+	httpAddr  string
+	httpsAddr string
+	grpcAddr  string
+	grpcsAddr string
+	host      HostInfo // host info in the responses
+	cmd       *exec.Cmd
+	exited    chan struct{}
+	stdout    *selftestOutput
+	stderr    *selftestOutput
+}
+
+// selftestOutput ... stdout/stderr of the gelbo under test with exclusive control
+type selftestOutput struct {
+	*sync.Mutex
+	buf bytes.Buffer
+}
+
+// selftestCheck ... a check of the selftest. run returns the reason when it fails
+type selftestCheck struct {
+	name string
+	run  func(env *selftestEnv) error
+}
+
+// SelftestResult ... the result of a check
+type SelftestResult struct {
+	Name     string  `json:"name"`
+	Passed   bool    `json:"passed"`
+	Duration float64 `json:"duration"` // millisecond
+	Error    string  `json:"error,omitempty"`
+}
+
+// SelftestSummary ... the summary of the selftest
+type SelftestSummary struct {
+	Total    int      `json:"total"`
+	Passed   int      `json:"passed"`
+	Failed   int      `json:"failed"`
+	Elapsed  float64  `json:"elapsed"` // second
+	Failures []string `json:"failures,omitempty"`
+}
+
+// runSelftest starts gelbo on ephemeral ports, runs the checks against it and prints the results
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	bin := fs.String("bin", "", "gelbo binary tested. if empty, this executable")
+	run := fs.String("run", "", "regexp of the check names run (e.g. \"^grpcs/\"). if empty, all checks")
+	verbose := fs.Bool("v", false, "print the passed checks too")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Printf("invalid value \"%s\" for flag -run: %v\n", *run, err)
+		return 2
+	}
+	if *bin == "" {
+		if *bin, err = os.Executable(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	env, err := startSelftestServer(*bin)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer env.stop()
+
+	start := time.Now()
+	summary := SelftestSummary{}
+	for _, check := range selftestChecks() {
+		if !filter.MatchString(check.name) {
+			continue
+		}
+		result := runSelftestCheck(env, check)
+		summary.Total++
+		if result.Passed {
+			summary.Passed++
+			if *verbose {
+				fmt.Printf("PASS %s (%vms)\n", result.Name, result.Duration)
+			}
+		} else {
+			summary.Failed++
+			summary.Failures = append(summary.Failures, result.Name)
+			fmt.Printf("FAIL %s (%vms): %s\n", result.Name, result.Duration, result.Error)
+		}
+	}
+	summary.Elapsed = math.Round(time.Since(start).Seconds()*1000) / 1000
+	summaryJSON, _ := jsonMarshalIndent(summary)
+	fmt.Println(string(summaryJSON))
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runSelftestCheck(env *selftestEnv, check selftestCheck) SelftestResult {
+	start := time.Now()
+	err := check.run(env)
+	result := SelftestResult{Name: check.name, Passed: err == nil, Duration: durationMillis(time.Since(start))}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// startSelftestServer starts bin as gelbo on ephemeral ports and waits until all the listeners are ready
+func startSelftestServer(bin string) (*selftestEnv, error) {
+	ports, err := freePorts(4)
+	if err != nil {
+		return nil, err
+	}
+	env := &selftestEnv{
+		httpAddr:  net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[0])),
+		httpsAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[1])),
+		grpcAddr:  net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[2])),
+		grpcsAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[3])),
+		exited:    make(chan struct{}),
+		stdout:    &selftestOutput{Mutex: &sync.Mutex{}},
+		stderr:    &selftestOutput{Mutex: &sync.Mutex{}},
+	}
+	env.cmd = exec.Command(bin,
+		"-http", strconv.Itoa(ports[0]), "-https", strconv.Itoa(ports[1]),
+		"-grpc", strconv.Itoa(ports[2]), "-grpcs", strconv.Itoa(ports[3]))
+	env.cmd.Env = append(os.Environ(), selftestServerEnv+"=1")
+	env.cmd.Stdout, env.cmd.Stderr = env.stdout, env.stderr
+	if err := env.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		env.cmd.Wait()
+		close(env.exited)
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		err := env.ready()
+		if err == nil {
+			break
+		}
+		select {
+		case <-env.exited:
+			return nil, fmt.Errorf("gelbo exited: %s%s", env.stdout, env.stderr)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			env.stop()
+			return nil, fmt.Errorf("gelbo is not ready: %v", err)
+		}
+	}
+	res, err := env.httpGet("http", "/", "", nil)
+	if err != nil {
+		env.stop()
+		return nil, err
+	}
+	env.host = res.info.Host
+	return env, nil
+}
+
+// freePorts returns n ports not in use
+func freePorts(n int) ([]int, error) {
+	ports := []int{}
+	for range n {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer ln.Close()
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+func (env *selftestEnv) ready() error {
+	for _, proto := range []string{"http", "https"} {
+		resp, err := env.httpClient(proto).Get(env.httpURL(proto, "/monitor/?raw"))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	for _, addr := range []string{env.grpcAddr, env.grpcsAddr} {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+func (env *selftestEnv) stop() {
+	env.cmd.Process.Kill()
+	<-env.exited
+}
+
+func (o *selftestOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *selftestOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.String()
+}
+
+func (o *selftestOutput) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.Len()
+}
+
+// waitLine waits for a line written after offset that match returns true
+func (o *selftestOutput) waitLine(offset int, match func(line string) bool) error {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		o.Lock()
+		written := o.buf.String()[offset:]
+		o.Unlock()
+		for _, line := range strings.Split(written, "\n") {
+			if match(line) {
+				return nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("expected line is not written")
+}
+
+// selftestChecks returns all the checks in the order they are run
+func selftestChecks() []selftestCheck {
+	checks := monitorChecks()
+	for _, proto := range []string{"http", "h2c", "https", "h2"} {
+		checks = append(checks, httpChecks(proto)...)
+	}
+	for _, proto := range []string{"grpc", "grpcs"} {
+		checks = append(checks, grpcChecks(proto)...)
+	}
+	checks = append(checks, grpcParamChecks()...)
+	for _, proto := range []string{"ws", "wss"} {
+		checks = append(checks, wsChecks(proto)...)
+	}
+	return checks
+}
+
+// === HTTP (http, h2c, https, h2)
+
+// selftestHTTPResponse ... a response of gelbo. the body is read and closed
+type selftestHTTPResponse struct {
+	*http.Response
+	body    []byte
+	info    selftestResponseInfo
+	elapsed time.Duration
+}
+
+// selftestResponseInfo ... ResponseInfo with the directions decoded as maps (including the if directives)
+type selftestResponseInfo struct {
+	ResponseInfo
+	Direction struct {
+		Input  map[string]string `json:"input"`
+		Result map[string]string `json:"result"`
+	} `json:"direction"`
+}
+
+// httpClient returns the client of the proto. a new connection is used for each request.
+func (env *selftestEnv) httpClient(proto string) *http.Client {
+	transport := newClientTransport(true, 1)
+	transport.DisableKeepAlives = true
+	transport.Protocols = &http.Protocols{}
+	switch proto {
+	case "h2":
+		transport.Protocols.SetHTTP2(true)
+	case "h2c":
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		transport.Protocols.SetHTTP1(true)
+	}
+	return &http.Client{Transport: transport, Timeout: selftestTimeout}
+}
+
+func (env *selftestEnv) httpURL(proto, path string) string {
+	if proto == "https" || proto == "h2" {
+		return "https://" + env.httpsAddr + path
+	}
+	return "http://" + env.httpAddr + path
+}
+
+func (env *selftestEnv) httpGet(proto, path, query string, header http.Header) (*selftestHTTPResponse, error) {
+	url := env.httpURL(proto, path)
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	start := time.Now()
+	resp, err := env.httpClient(proto).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &selftestHTTPResponse{Response: resp}
+	if res.body, err = io.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	res.elapsed = time.Since(start)
+	// the body may be followed by the padding of size
+	json.NewDecoder(bytes.NewReader(res.body)).Decode(&res.info)
+	return res, nil
+}
+
+// expect checks the status code and the results of the directives
+func (res *selftestHTTPResponse) expect(statusCode int, results map[string]string) error {
+	if res.StatusCode != statusCode {
+		return fmt.Errorf("status = %d, want %d", res.StatusCode, statusCode)
+	}
+	return expectResults(res.info.Direction.Result, results)
+}
+
+func expectResults(got, want map[string]string) error {
+	for key, value := range want {
+		if got[key] != value {
+			return fmt.Errorf("result of %s = %q, want %q", key, got[key], value)
+		}
+	}
+	return nil
+}
+
+func httpChecks(proto string) []selftestCheck {
+	headerName := "X-Selftest-" + strings.ToUpper(proto[:1]) + proto[1:]
+	return []selftestCheck{
+		{proto + "/protocol", func(env *selftestEnv) error {
+			res, err := env.httpGet(proto, "/", "", nil)
+			if err != nil {
+				return err
+			}
+			if err := res.expect(http.StatusOK, nil); err != nil {
+				return err
+			}
+			if res.info.Request.Proto != proto {
+				return fmt.Errorf("protocol = %q, want %q", res.info.Request.Proto, proto)
+			}
+			if res.ContentLength != int64(len(res.body)) {
+				return fmt.Errorf("Content-Length = %d, body = %d bytes", res.ContentLength, len(res.body))
+			}
+			return nil
+		}},
+		{proto + "/sleep", func(env *selftestEnv) error {
+			res, err := env.httpGet(proto, "/", "sleep=300", nil)
+			if err != nil {
+				return err
+			}
+			if err := res.expect(http.StatusOK, map[string]string{"sleep": "300"}); err != nil {
+				return err
+			}
+			if res.elapsed < 300*time.Millisecond {
+				return fmt.Errorf("responded in %v with sleep=300", res.elapsed)
+			}
+			res, err = env.httpGet(proto, "/", "sleep=100-200", nil)
+			if err != nil {
+				return err
+			}
+			sleep, _ := strconv.Atoi(res.info.Direction.Result["sleep"])
+			if sleep < 100 || sleep > 200 {
+				return fmt.Errorf("result of sleep = %q, want 100-200", res.info.Direction.Result["sleep"])
+			}
+			if res.elapsed < time.Duration(sleep)*time.Millisecond {
+				return fmt.Errorf("responded in %v with sleep=%d", res.elapsed, sleep)
+			}
+			return nil
+		}},
+		{proto + "/size", func(env *selftestEnv) error {
+			for _, size := range []int{10, 100000} {
+				res, err := env.httpGet(proto, "/", "size="+strconv.Itoa(size), nil)
+				if err != nil {
+					return err
+				}
+				if len(res.body) != size || res.ContentLength != int64(size) {
+					return fmt.Errorf("size=%d responded %d bytes (Content-Length %d)", size, len(res.body), res.ContentLength)
+				}
+			}
+			return nil
+		}},
+		{proto + "/status", func(env *selftestEnv) error {
+			for _, statusCode := range []int{418, 503} {
+				res, err := env.httpGet(proto, "/", "status="+strconv.Itoa(statusCode), nil)
+				if err != nil {
+					return err
+				}
+				if err := res.expect(statusCode, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{proto + "/addheader", func(env *selftestEnv) error {
+			res, err := env.httpGet(proto, "/", "addheader="+headerName+":+on", nil)
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(res.Header.Get(headerName)) != "on" {
+				return fmt.Errorf("%s is not added", headerName)
+			}
+			// the header is added to the following responses
+			if res, err = env.httpGet(proto, "/", "", nil); err != nil {
+				return err
+			}
+			if strings.TrimSpace(res.Header.Get(headerName)) != "on" {
+				return fmt.Errorf("%s is not added to the next response", headerName)
+			}
+			return nil
+		}},
+		{proto + "/delheader", func(env *selftestEnv) error {
+			for _, query := range []string{"delheader=" + headerName, ""} {
+				res, err := env.httpGet(proto, "/", query, nil)
+				if err != nil {
+					return err
+				}
+				if _, ok := res.Header[headerName]; ok {
+					return fmt.Errorf("%s is not deleted", headerName)
+				}
+			}
+			return nil
+		}},
+		{proto + "/chunk", func(env *selftestEnv) error {
+			res, err := env.httpGet(proto, "/", "chunk=on&size=3000", nil)
+			if err != nil {
+				return err
+			}
+			if err := res.expect(http.StatusOK, map[string]string{"chunk": "chunked when using HTTP/1.1"}); err != nil {
+				return err
+			}
+			if len(res.body) != 3000 {
+				return fmt.Errorf("chunk=on&size=3000 responded %d bytes", len(res.body))
+			}
+			// HTTP/2 has no chunked encoding
+			if res.ProtoMajor == 1 && (res.ContentLength != -1 || !slices.Contains(res.TransferEncoding, "chunked")) {
+				return fmt.Errorf("Content-Length = %d, Transfer-Encoding = %v", res.ContentLength, res.TransferEncoding)
+			}
+			return nil
+		}},
+		{proto + "/stdout", func(env *selftestEnv) error {
+			return expectOutput(env.stdout, "stdout", func(marker string) error {
+				_, err := env.httpGet(proto, "/", "stdout="+marker, nil)
+				return err
+			})
+		}},
+		{proto + "/stderr", func(env *selftestEnv) error {
+			return expectOutput(env.stderr, "stderr", func(marker string) error {
+				_, err := env.httpGet(proto, "/", "stderr="+marker, nil)
+				return err
+			})
+		}},
+		{proto + "/disconnect", func(env *selftestEnv) error {
+			for _, mode := range []string{"fin", "rst"} {
+				if res, err := env.httpGet(proto, "/", "disconnect="+mode, nil); err == nil {
+					return fmt.Errorf("disconnect=%s responded %d", mode, res.StatusCode)
+				}
+			}
+			return nil
+		}},
+		{proto + "/cpu+memory", func(env *selftestEnv) error {
+			for _, target := range []float64{1, 0} {
+				value := strconv.FormatFloat(target, 'f', -1, 64)
+				if _, err := env.httpGet(proto, "/", "cpu="+value+"&memory="+value, nil); err != nil {
+					return err
+				}
+				res, err := env.httpGet(proto, "/", "", nil)
+				if err != nil {
+					return err
+				}
+				if res.info.Resource.CPU.Target != target || res.info.Resource.Memory.Target != target {
+					return fmt.Errorf("targets are cpu %v, memory %v, want %v",
+						res.info.Resource.CPU.Target, res.info.Resource.Memory.Target, target)
+				}
+			}
+			return nil
+		}},
+		{proto + "/if", func(env *selftestEnv) error {
+			header := http.Header{"X-Forwarded-For": {selftestXFF}}
+			matches := map[string]string{
+				"ifclientip":  "198.51.100.1",
+				"ifproxy1ip":  "198.51.100.2",
+				"ifproxy2ip":  "10.0.0.0/8 or 198.51.100.0/24",
+				"ifproxy3ip":  "198.51.100.4",
+				"iflasthopip": "127.0.0.1",
+				"iftargetip":  "127.0.0.0/8",
+			}
+			if env.host.IP != "" {
+				matches["ifhostip"] = env.host.IP
+			}
+			if regexp.MustCompile("^[a-zA-Z0-9-.]+$").MatchString(env.host.Name) {
+				matches["ifhost"] = env.host.Name
+			}
+			return expectIfDirectives(matches, func(query string) (map[string]string, bool, error) {
+				res, err := env.httpGet(proto, "/", query+"&status=202", header)
+				if err != nil {
+					return nil, false, err
+				}
+				return res.info.Direction.Result, res.StatusCode == http.StatusAccepted, nil
+			})
+		}},
+		{proto + "/invalid", func(env *selftestEnv) error {
+			res, err := env.httpGet(proto, "/", "status=99&sleep=abc", nil)
+			if err != nil {
+				return err
+			}
+			return res.expect(http.StatusOK, map[string]string{"status": "invalid", "sleep": "invalid"})
+		}},
+	}
+}
+
+// expectOutput runs the directive writing a marker and waits for the marker line in output
+func expectOutput(output *selftestOutput, directive string, run func(marker string) error) error {
+	marker := fmt.Sprintf("selftest-%s-%d", directive, time.Now().UnixNano())
+	offset := output.Len()
+	if err := run(marker); err != nil {
+		return err
+	}
+	// the access log also contains the marker, but not as a line
+	if err := output.waitLine(offset, func(line string) bool { return line == marker }); err != nil {
+		return fmt.Errorf("%s is not written to %s", marker, directive)
+	}
+	return nil
+}
+
+// expectIfDirectives checks the if directives match and an unmatched one suppresses the actions.
+// request sends the directives and returns the results and whether the actions are executed.
+func expectIfDirectives(matches map[string]string, request func(query string) (map[string]string, bool, error)) error {
+	query, results := []string{}, map[string]string{}
+	for key, value := range matches {
+		query = append(query, key+"="+strings.ReplaceAll(value, " ", "+"))
+		results[key] = "matched"
+	}
+	got, executed, err := request(strings.Join(query, "&"))
+	if err != nil {
+		return err
+	}
+	if err := expectResults(got, results); err != nil {
+		return err
+	}
+	if !executed {
+		return errors.New("actions are not executed when all if directives match")
+	}
+	// the az and the instance type are empty except on AWS, and documentation addresses are never matched
+	unmatched := "ifclientip=192.0.2.1&iftargetip=127.0.0.1+or+192.0.2.0/24"
+	if got, executed, err = request(unmatched); err != nil {
+		return err
+	}
+	if err := expectResults(got, map[string]string{"ifclientip": "unmatched", "iftargetip": "matched"}); err != nil {
+		return err
+	}
+	if executed {
+		return errors.New("actions are executed with an unmatched if directive")
+	}
+	return nil
+}
+
+// === gRPC (grpc, grpcs)
+
+func (env *selftestEnv) grpcClient(proto string) (*grpc.ClientConn, pb.GelboServiceClient, error) {
+	addr, creds := env.grpcAddr, insecure.NewCredentials()
+	if proto == "grpcs" {
+		addr, creds = env.grpcsAddr, credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, pb.NewGelboServiceClient(conn), nil
+}
+
+// grpcUnary sends a unary call on a new connection
+func (env *selftestEnv) grpcUnary(proto string, req *pb.GelboRequest, opts ...grpc.CallOption) (*pb.GelboResponse, error) {
+	conn, client, err := env.grpcClient(proto)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	return client.Unary(ctx, req, opts...)
+}
+
+// grpcServerStream sends a server streaming call on a new connection and returns all the responses
+func (env *selftestEnv) grpcServerStream(proto string, req *pb.GelboRequest) ([]*pb.GelboResponse, error) {
+	conn, client, err := env.grpcClient(proto)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	stream, err := client.ServerStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resps := []*pb.GelboResponse{}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return resps, nil
+		}
+		if err != nil {
+			return resps, err
+		}
+		resps = append(resps, resp)
+	}
+}
+
+func expectCode(err error, code codes.Code) error {
+	if status.Code(err) != code {
+		return fmt.Errorf("code = %v (%v), want %v", status.Code(err), err, code)
+	}
+	return nil
+}
+
+// trimValues trims the values of the metadata (gelbo keeps the space after the colon of addheader)
+func trimValues(values []string) []string {
+	trimmed := []string{}
+	for _, value := range values {
+		trimmed = append(trimmed, strings.TrimSpace(value))
+	}
+	return trimmed
+}
+
+// grpcResults converts the direction of the response ("key: value") to a map
+func grpcResults(resp *pb.GelboResponse) map[string]string {
+	results := map[string]string{}
+	for _, kv := range resp.GetDirection().GetResult() {
+		if key, value, ok := strings.Cut(kv, ": "); ok {
+			results[key] = value
+		}
+	}
+	return results
+}
+
+func grpcChecks(proto string) []selftestCheck {
+	headerName := "x-selftest-" + proto
+	return []selftestCheck{
+		{proto + "/protocol", func(env *selftestEnv) error {
+			resp, err := env.grpcUnary(proto, &pb.GelboRequest{})
+			if err != nil {
+				return err
+			}
+			if resp.GetRequest().GetProtocol() != proto {
+				return fmt.Errorf("protocol = %q, want %q", resp.GetRequest().GetProtocol(), proto)
+			}
+			if resp.GetHost().GetName() != env.host.Name {
+				return fmt.Errorf("host name = %q, want %q", resp.GetHost().GetName(), env.host.Name)
+			}
+			return nil
+		}},
+		{proto + "/sleep", func(env *selftestEnv) error {
+			start := time.Now()
+			if _, err := env.grpcUnary(proto, &pb.GelboRequest{Sleep: "300"}); err != nil {
+				return err
+			}
+			if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+				return fmt.Errorf("responded in %v with sleep=300", elapsed)
+			}
+			return nil
+		}},
+		{proto + "/size", func(env *selftestEnv) error {
+			resp, err := env.grpcUnary(proto, &pb.GelboRequest{Size: "100000"})
+			if err != nil {
+				return err
+			}
+			if len(resp.GetData()) != 100000 {
+				return fmt.Errorf("size=100000 responded %d bytes of data", len(resp.GetData()))
+			}
+			return nil
+		}},
+		{proto + "/code", func(env *selftestEnv) error {
+			for code := range codes.Code(17) {
+				_, err := env.grpcUnary(proto, &pb.GelboRequest{Code: strconv.Itoa(int(code))})
+				if err := expectCode(err, code); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{proto + "/addheader", func(env *selftestEnv) error {
+			for _, req := range []*pb.GelboRequest{{Addheader: headerName + ": on"}, {}} {
+				var header metadata.MD
+				if _, err := env.grpcUnary(proto, req, grpc.Header(&header)); err != nil {
+					return err
+				}
+				if !slices.Contains(trimValues(header.Get(headerName)), "on") {
+					return fmt.Errorf("%s is not in the header metadata %v", headerName, header)
+				}
+			}
+			return nil
+		}},
+		{proto + "/delheader", func(env *selftestEnv) error {
+			for _, req := range []*pb.GelboRequest{{Delheader: headerName}, {}} {
+				var header metadata.MD
+				if _, err := env.grpcUnary(proto, req, grpc.Header(&header)); err != nil {
+					return err
+				}
+				if len(header.Get(headerName)) != 0 {
+					return fmt.Errorf("%s is not deleted from the header metadata", headerName)
+				}
+			}
+			return nil
+		}},
+		{proto + "/addtrailer", func(env *selftestEnv) error {
+			for _, req := range []*pb.GelboRequest{{Addtrailer: headerName + ": on"}, {}} {
+				var trailer metadata.MD
+				if _, err := env.grpcUnary(proto, req, grpc.Trailer(&trailer)); err != nil {
+					return err
+				}
+				if !slices.Contains(trimValues(trailer.Get(headerName)), "on") {
+					return fmt.Errorf("%s is not in the trailer metadata %v", headerName, trailer)
+				}
+			}
+			return nil
+		}},
+		{proto + "/deltrailer", func(env *selftestEnv) error {
+			for _, req := range []*pb.GelboRequest{{Deltrailer: headerName}, {}} {
+				var trailer metadata.MD
+				if _, err := env.grpcUnary(proto, req, grpc.Trailer(&trailer)); err != nil {
+					return err
+				}
+				if len(trailer.Get(headerName)) != 0 {
+					return fmt.Errorf("%s is not deleted from the trailer metadata", headerName)
+				}
+			}
+			return nil
+		}},
+		{proto + "/repeat", func(env *selftestEnv) error {
+			resps, err := env.grpcServerStream(proto, &pb.GelboRequest{Repeat: "3"})
+			if err != nil {
+				return err
+			}
+			if len(resps) != 3 {
+				return fmt.Errorf("repeat=3 responded %d messages", len(resps))
+			}
+			// repeat is not valid for the unary calls
+			resp, err := env.grpcUnary(proto, &pb.GelboRequest{Repeat: "3"})
+			if err != nil {
+				return err
+			}
+			return expectResults(grpcResults(resp), map[string]string{"repeat": "invalid"})
+		}},
+		{proto + "/dataonly", func(env *selftestEnv) error {
+			resp, err := env.grpcUnary(proto, &pb.GelboRequest{Size: "10", Dataonly: "on"})
+			if err != nil {
+				return err
+			}
+			if resp.GetHost() != nil || resp.GetDirection() != nil || len(resp.GetData()) != 10 {
+				return fmt.Errorf("dataonly responded %v", resp)
+			}
+			return nil
+		}},
+		{proto + "/noop", func(env *selftestEnv) error {
+			resps, err := env.grpcServerStream(proto, &pb.GelboRequest{Noop: "on"})
+			if err != nil {
+				return err
+			}
+			if len(resps) != 0 {
+				return fmt.Errorf("noop responded %d messages", len(resps))
+			}
+			return nil
+		}},
+		{proto + "/ignoredeadline", func(env *selftestEnv) error {
+			conn, client, err := env.grpcClient(proto)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			offset := env.stdout.Len()
+			_, err = client.Unary(ctx, &pb.GelboRequest{Sleep: "500", Ignoredeadline: "on"})
+			if err := expectCode(err, codes.DeadlineExceeded); err != nil {
+				return err
+			}
+			// the sleep continues after the deadline and is logged as orphaned
+			err = env.stdout.waitLine(offset, func(line string) bool {
+				return strings.Contains(line, `"action":"orphaned"`) && strings.Contains(line, `"proto":"`+proto+`"`)
+			})
+			if err != nil {
+				return errors.New("orphaned work is not logged")
+			}
+			return nil
+		}},
+		{proto + "/stdout", func(env *selftestEnv) error {
+			return expectOutput(env.stdout, "stdout", func(marker string) error {
+				_, err := env.grpcUnary(proto, &pb.GelboRequest{Stdout: marker})
+				return err
+			})
+		}},
+		{proto + "/stderr", func(env *selftestEnv) error {
+			return expectOutput(env.stderr, "stderr", func(marker string) error {
+				_, err := env.grpcUnary(proto, &pb.GelboRequest{Stderr: marker})
+				return err
+			})
+		}},
+		{proto + "/disconnect", func(env *selftestEnv) error {
+			for _, mode := range []string{"fin", "rst"} {
+				_, err := env.grpcUnary(proto, &pb.GelboRequest{Disconnect: mode})
+				if err := expectCode(err, codes.Unavailable); err != nil {
+					return fmt.Errorf("disconnect=%s: %v", mode, err)
+				}
+			}
+			return nil
+		}},
+		{proto + "/cpu+memory", func(env *selftestEnv) error {
+			for _, target := range []float64{1, 0} {
+				value := strconv.FormatFloat(target, 'f', -1, 64)
+				resp, err := env.grpcUnary(proto, &pb.GelboRequest{Cpu: value, Memory: value})
+				if err != nil {
+					return err
+				}
+				if resp.GetResource().GetCpu().GetTarget() != target || resp.GetResource().GetMemory().GetTarget() != target {
+					return fmt.Errorf("targets are cpu %v, memory %v, want %v",
+						resp.GetResource().GetCpu().GetTarget(), resp.GetResource().GetMemory().GetTarget(), target)
+				}
+			}
+			return nil
+		}},
+		{proto + "/if", func(env *selftestEnv) error {
+			matches := map[string]string{
+				"ifclientip":  "198.51.100.1",
+				"ifproxy1ip":  "198.51.100.2",
+				"ifproxy2ip":  "10.0.0.0/8 or 198.51.100.0/24",
+				"ifproxy3ip":  "198.51.100.4",
+				"iflasthopip": "127.0.0.1",
+				"iftargetip":  "127.0.0.0/8",
+			}
+			return expectIfDirectives(matches, func(query string) (map[string]string, bool, error) {
+				req := &pb.GelboRequest{Size: "1"}
+				for _, kv := range strings.Split(query, "&") {
+					key, value, _ := strings.Cut(kv, "=")
+					setGrpcRequestField(req, key, strings.ReplaceAll(value, "+", " "))
+				}
+				conn, client, err := env.grpcClient(proto)
+				if err != nil {
+					return nil, false, err
+				}
+				defer conn.Close()
+				ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+				defer cancel()
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", selftestXFF)
+				resp, err := client.Unary(ctx, req)
+				if err != nil {
+					return nil, false, err
+				}
+				return grpcResults(resp), len(resp.GetData()) == 1, nil
+			})
+		}},
+		{proto + "/invalid", func(env *selftestEnv) error {
+			resp, err := env.grpcUnary(proto, &pb.GelboRequest{Code: "99", Sleep: "abc"})
+			if err != nil {
+				return err
+			}
+			return expectResults(grpcResults(resp), map[string]string{"code": "invalid", "sleep": "invalid"})
+		}},
+		{proto + "/clientstream", func(env *selftestEnv) error {
+			conn, client, err := env.grpcClient(proto)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+			defer cancel()
+			stream, err := client.ClientStream(ctx)
+			if err != nil {
+				return err
+			}
+			// the directives of the last message are executed
+			for _, size := range []string{"1", "2", "7"} {
+				if err := stream.Send(&pb.GelboRequest{Size: size}); err != nil {
+					return err
+				}
+			}
+			resp, err := stream.CloseAndRecv()
+			if err != nil {
+				return err
+			}
+			if len(resp.GetData()) != 7 {
+				return fmt.Errorf("responded %d bytes of data, want 7", len(resp.GetData()))
+			}
+			return nil
+		}},
+		{proto + "/bidistream", func(env *selftestEnv) error {
+			conn, client, err := env.grpcClient(proto)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+			defer cancel()
+			stream, err := client.BidiStream(ctx)
+			if err != nil {
+				return err
+			}
+			for range 3 {
+				if err := stream.Send(&pb.GelboRequest{Size: "5"}); err != nil {
+					return err
+				}
+			}
+			stream.CloseSend()
+			count := 0
+			for {
+				resp, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if len(resp.GetData()) != 5 {
+					return fmt.Errorf("responded %d bytes of data, want 5", len(resp.GetData()))
+				}
+				count++
+			}
+			if count != 3 {
+				return fmt.Errorf("responded %d messages to 3 requests", count)
+			}
+			return nil
+		}},
+	}
+}
+
+// setGrpcRequestField sets the directive to the field of the request
+func setGrpcRequestField(req *pb.GelboRequest, key, value string) {
+	fields := map[string]*string{
+		"ifclientip": &req.Ifclientip, "ifproxy1ip": &req.Ifproxy1Ip, "ifproxy2ip": &req.Ifproxy2Ip,
+		"ifproxy3ip": &req.Ifproxy3Ip, "iflasthopip": &req.Iflasthopip, "iftargetip": &req.Iftargetip,
+		"ifhostip": &req.Ifhostip, "ifhost": &req.Ifhost, "ifaz": &req.Ifaz, "iftype": &req.Iftype,
+	}
+	if field, ok := fields[key]; ok {
+		*field = value
+	}
+}
+
+// === gRPC server parameters (changed by both HTTP and gRPC directives)
+
+// resetGrpcParams restores the grpc server parameters gelbo started with
+func (env *selftestEnv) resetGrpcParams() {
+	env.httpGet("http", "/", selftestGrpcDefaults, nil)
+}
+
+// grpcConcurrentCalls sends calls with sleep=300 concurrently on a connection and returns the elapsed time
+func (env *selftestEnv) grpcConcurrentCalls(calls int) (time.Duration, error) {
+	conn, client, err := env.grpcClient("grpc")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	// connect before measuring
+	if _, err := client.Unary(ctx, &pb.GelboRequest{}); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	errs := make(chan error, calls)
+	for range calls {
+		go func() {
+			_, err := client.Unary(ctx, &pb.GelboRequest{Sleep: "300"})
+			errs <- err
+		}()
+	}
+	for range calls {
+		if err := <-errs; err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+// expectGoaway waits for the server to close the idle connection (the client goes out of READY)
+func (env *selftestEnv) expectGoaway(proto string) error {
+	conn, client, err := env.grpcClient(proto)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	if _, err := client.Unary(ctx, &pb.GelboRequest{}); err != nil {
+		return err
+	}
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if !conn.WaitForStateChange(waitCtx, connectivity.Ready) {
+		return errors.New("connection is not closed by the server")
+	}
+	return nil
+}
+
+func grpcParamChecks() []selftestCheck {
+	return []selftestCheck{
+		{"http/grpcmaxstreams", func(env *selftestEnv) error {
+			defer env.resetGrpcParams()
+			res, err := env.httpGet("http", "/", "grpcmaxstreams=1", nil)
+			if err != nil {
+				return err
+			}
+			if err := res.expect(http.StatusOK, map[string]string{"grpcmaxstreams": "1"}); err != nil {
+				return err
+			}
+			elapsed, err := env.grpcConcurrentCalls(2)
+			if err != nil {
+				return err
+			}
+			if elapsed < 550*time.Millisecond {
+				return fmt.Errorf("2 calls on a connection finished in %v with grpcmaxstreams=1", elapsed)
+			}
+			env.resetGrpcParams()
+			if elapsed, err = env.grpcConcurrentCalls(2); err != nil {
+				return err
+			}
+			if elapsed >= 550*time.Millisecond {
+				return fmt.Errorf("2 calls on a connection finished in %v with no limit", elapsed)
+			}
+			return nil
+		}},
+		{"http/grpcparams", func(env *selftestEnv) error {
+			defer env.resetGrpcParams()
+			params := map[string]string{
+				"grpcping": "10", "grpcpingtimeout": "5", "grpcminpingtime": "5",
+				"grpcwindow": "65535", "grpcconnwindow": "131072",
+			}
+			query := []string{}
+			for key, value := range params {
+				query = append(query, key+"="+value)
+			}
+			res, err := env.httpGet("http", "/", strings.Join(query, "&"), nil)
+			if err != nil {
+				return err
+			}
+			if err := res.expect(http.StatusOK, params); err != nil {
+				return err
+			}
+			// the calls succeed on the servers restarted with the parameters
+			resp, err := env.grpcUnary("grpcs", &pb.GelboRequest{Size: "1000000"})
+			if err != nil {
+				return err
+			}
+			if len(resp.GetData()) != 1000000 {
+				return fmt.Errorf("size=1000000 responded %d bytes of data", len(resp.GetData()))
+			}
+			return nil
+		}},
+		{"grpc/grpcmaxidle", func(env *selftestEnv) error {
+			defer env.resetGrpcParams()
+			resp, err := env.grpcUnary("grpc", &pb.GelboRequest{Grpcmaxidle: "1"})
+			if err != nil {
+				return err
+			}
+			if err := expectResults(grpcResults(resp), map[string]string{"grpcmaxidle": "1"}); err != nil {
+				return err
+			}
+			return env.expectGoaway("grpc")
+		}},
+		{"grpcs/grpcmaxage", func(env *selftestEnv) error {
+			defer env.resetGrpcParams()
+			resp, err := env.grpcUnary("grpcs", &pb.GelboRequest{Grpcmaxage: "1", Grpcmaxagegrace: "1"})
+			if err != nil {
+				return err
+			}
+			if err := expectResults(grpcResults(resp), map[string]string{"grpcmaxage": "1", "grpcmaxagegrace": "1"}); err != nil {
+				return err
+			}
+			return env.expectGoaway("grpcs")
+		}},
+	}
+}
+
+// === WebSocket (ws, wss)
+
+// selftestWsConn ... a websocket connection splitting the text frames into the messages
+type selftestWsConn struct {
+	*websocket.Conn
+	pending []WsData
+}
+
+func (env *selftestEnv) wsDial(proto string) (*selftestWsConn, error) {
+	url := "ws://" + env.httpAddr + "/ws/"
+	if proto == "wss" {
+		url = "wss://" + env.httpsAddr + "/ws/"
+	}
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: selftestTimeout,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(selftestTimeout))
+	return &selftestWsConn{Conn: conn}, nil
+}
+
+// close closes the connection normally
+func (c *selftestWsConn) close() {
+	c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.Close()
+}
+
+// readFrame reads a frame. the messages in the text frame are kept for waitMessage
+func (c *selftestWsConn) readFrame() (int, []byte, error) {
+	messageType, data, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	if messageType == websocket.TextMessage {
+		for _, message := range bytes.Split(data, newline) {
+			var wsData WsData
+			if json.Unmarshal(message, &wsData) == nil {
+				c.pending = append(c.pending, wsData)
+			}
+		}
+	}
+	return messageType, data, nil
+}
+
+// waitFrame reads the frames until match returns true
+func (c *selftestWsConn) waitFrame(match func(messageType int, data []byte) bool) ([]byte, error) {
+	for {
+		messageType, data, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if match(messageType, data) {
+			return data, nil
+		}
+	}
+}
+
+// waitMessage returns the first message that match returns true (the others are skipped)
+func (c *selftestWsConn) waitMessage(match func(WsData) bool) (WsData, error) {
+	for {
+		for len(c.pending) > 0 {
+			wsData := c.pending[0]
+			c.pending = c.pending[1:]
+			if match(wsData) {
+				return wsData, nil
+			}
+		}
+		if _, _, err := c.readFrame(); err != nil {
+			return WsData{}, err
+		}
+	}
+}
+
+func (c *selftestWsConn) waitReply(message string) error {
+	_, err := c.waitMessage(func(wsData WsData) bool {
+		return wsData.Type == "controlReply" && wsData.Message == message
+	})
+	if err != nil {
+		return fmt.Errorf("reply %q is not received: %v", message, err)
+	}
+	return nil
+}
+
+// wsCheck runs check on a new websocket connection
+func wsCheck(proto string, check func(conn *selftestWsConn) error) func(env *selftestEnv) error {
+	return func(env *selftestEnv) error {
+		conn, err := env.wsDial(proto)
+		if err != nil {
+			return err
+		}
+		defer conn.close()
+		return check(conn)
+	}
+}
+
+func wsChecks(proto string) []selftestCheck {
+	return []selftestCheck{
+		{proto + "/whoAmI", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "whoAmI"})
+			wsData, err := conn.waitMessage(func(wsData WsData) bool { return wsData.Type == "yourInfo" })
+			if err != nil {
+				return err
+			}
+			if wsData.User.ClientID == "" {
+				return fmt.Errorf("yourInfo has no client id: %+v", wsData)
+			}
+			return nil
+		})},
+		{proto + "/echoMessage", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "echoMessage", Message: "selftest echo"})
+			_, err := conn.waitMessage(func(wsData WsData) bool {
+				return wsData.Type == "echoReply" && wsData.Message == "selftest echo"
+			})
+			return err
+		})},
+		{proto + "/raw", wsCheck(proto, func(conn *selftestWsConn) error {
+			// the messages other than JSON are echoed as is
+			conn.WriteMessage(websocket.TextMessage, []byte("selftest raw"))
+			_, err := conn.waitFrame(func(messageType int, data []byte) bool {
+				return slices.ContainsFunc(bytes.Split(data, newline), func(message []byte) bool {
+					return string(message) == "selftest raw"
+				})
+			})
+			return err
+		})},
+		{proto + "/postToChat", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "postToChat", Message: "selftest chat"})
+			_, err := conn.waitMessage(func(wsData WsData) bool {
+				return wsData.Type == "deliverMessage" && wsData.Message == "selftest chat"
+			})
+			return err
+		})},
+		{proto + "/sendLarge", wsCheck(proto, func(conn *selftestWsConn) error {
+			for _, messageType := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+				conn.WriteJSON(WsData{Type: "sendLarge", Size: 200000, Binary: messageType == websocket.BinaryMessage})
+				_, err := conn.waitFrame(func(mt int, data []byte) bool { return mt == messageType && len(data) == 200000 })
+				if err != nil {
+					return fmt.Errorf("frame (type %d) of 200000 bytes is not received: %v", messageType, err)
+				}
+			}
+			return nil
+		})},
+		{proto + "/startTicker", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "startTicker", Interval: 20, Count: 3, Size: 8})
+			for seq := 1; seq <= 3; seq++ {
+				wsData, err := conn.waitMessage(func(wsData WsData) bool { return wsData.Type == "tick" })
+				if err != nil {
+					return err
+				}
+				if wsData.Seq != seq || len(wsData.Message) != 8 {
+					return fmt.Errorf("tick %d is seq %d with %d bytes", seq, wsData.Seq, len(wsData.Message))
+				}
+			}
+			return nil
+		})},
+		{proto + "/stopTicker", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "startTicker", Interval: 20})
+			if _, err := conn.waitMessage(func(wsData WsData) bool { return wsData.Type == "tick" }); err != nil {
+				return err
+			}
+			conn.WriteJSON(WsData{Type: "stopTicker"})
+			if err := conn.waitReply("ticker stopped"); err != nil {
+				return err
+			}
+			// no tick follows the reply
+			time.Sleep(200 * time.Millisecond)
+			conn.WriteJSON(WsData{Type: "echoMessage", Message: "after stopTicker"})
+			wsData, err := conn.waitMessage(func(wsData WsData) bool { return wsData.Type == "tick" || wsData.Type == "echoReply" })
+			if err != nil {
+				return err
+			}
+			if wsData.Type == "tick" {
+				return errors.New("tick is received after the ticker stopped")
+			}
+			return nil
+		})},
+		{proto + "/ignorePing", wsCheck(proto, func(conn *selftestWsConn) error {
+			pongs := 0
+			conn.SetPongHandler(func(string) error { pongs++; return nil })
+			// the pong to the ping is read before the echo reply
+			ping := func(message string) error {
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+				conn.WriteJSON(WsData{Type: "echoMessage", Message: message})
+				_, err := conn.waitMessage(func(wsData WsData) bool {
+					return wsData.Type == "echoReply" && wsData.Message == message
+				})
+				return err
+			}
+			conn.WriteJSON(WsData{Type: "ignorePing"})
+			if err := conn.waitReply("ignoring pings"); err != nil {
+				return err
+			}
+			if err := ping("ignored"); err != nil {
+				return err
+			}
+			if pongs != 0 {
+				return errors.New("pong is received while ignoring pings")
+			}
+			conn.WriteJSON(WsData{Type: "ignorePing", Mode: "off"})
+			if err := conn.waitReply("answering pings"); err != nil {
+				return err
+			}
+			if err := ping("answered"); err != nil {
+				return err
+			}
+			if pongs != 1 {
+				return fmt.Errorf("%d pongs are received while answering pings", pongs)
+			}
+			return nil
+		})},
+		{proto + "/stopReading", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "stopReading", Duration: 300})
+			if err := conn.waitReply("stop reading for 300ms"); err != nil {
+				return err
+			}
+			start := time.Now()
+			if err := conn.waitReply("resumed reading"); err != nil {
+				return err
+			}
+			if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+				return fmt.Errorf("resumed reading in %v", elapsed)
+			}
+			return nil
+		})},
+		{proto + "/sendClose", wsCheck(proto, func(conn *selftestWsConn) error {
+			conn.WriteJSON(WsData{Type: "sendClose", Code: 4001, Reason: "selftest"})
+			_, err := conn.waitMessage(func(WsData) bool { return false })
+			if !websocket.IsCloseError(err, 4001) {
+				return fmt.Errorf("closed with %v, want 4001", err)
+			}
+			return nil
+		})},
+		{proto + "/disconnect", func(env *selftestEnv) error {
+			for _, mode := range []string{"fin", "rst"} {
+				err := wsCheck(proto, func(conn *selftestWsConn) error {
+					conn.WriteJSON(WsData{Type: "disconnect", Mode: mode})
+					_, err := conn.waitMessage(func(WsData) bool { return false })
+					// closed without the close frame
+					var closeErr *websocket.CloseError
+					var netErr net.Error
+					if (errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure) ||
+						(errors.As(err, &netErr) && netErr.Timeout()) {
+						return fmt.Errorf("disconnect=%s closed with %v", mode, err)
+					}
+					return nil
+				})(env)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	}
+}
+
+// === /monitor/ counters
+
+func (env *selftestEnv) monitor() (*NodeInfo, error) {
+	res, err := env.httpGet("http", "/monitor/", "raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	node := &NodeInfo{}
+	if err := json.Unmarshal(res.body, node); err != nil {
+		return nil, err
+	}
+	if node.WebSocket == nil {
+		node.WebSocket = &WebSocketStats{}
+	}
+	return node, nil
+}
+
+func monitorChecks() []selftestCheck {
+	return []selftestCheck{
+		{"monitor/request_count", func(env *selftestEnv) error {
+			before, err := env.monitor()
+			if err != nil {
+				return err
+			}
+			sent := int64(0)
+			for range 5 {
+				res, err := env.httpGet("http", "/", "", nil)
+				if err != nil {
+					return err
+				}
+				sent += int64(len(res.body))
+			}
+			after, err := env.monitor()
+			if err != nil {
+				return err
+			}
+			if count := after.RequestCount - before.RequestCount; count != 5 {
+				return fmt.Errorf("request_count increased by %d with 5 requests", count)
+			}
+			if bytes := after.SentBytes - before.SentBytes; bytes != sent {
+				return fmt.Errorf("sent_bytes increased by %d with %d bytes responded", bytes, sent)
+			}
+			return nil
+		}},
+		{"monitor/websocket", func(env *selftestEnv) error {
+			before, err := env.monitor()
+			if err != nil {
+				return err
+			}
+			conn, err := env.wsDial("ws")
+			if err != nil {
+				return err
+			}
+			conn.WriteJSON(WsData{Type: "echoMessage", Message: "selftest monitor"})
+			if _, err := conn.waitMessage(func(wsData WsData) bool { return wsData.Type == "echoReply" }); err != nil {
+				conn.Close()
+				return err
+			}
+			conn.close()
+			// the stats are updated when gelbo reads the close frame
+			var after *NodeInfo
+			for range 30 {
+				if after, err = env.monitor(); err != nil {
+					return err
+				}
+				if after.WebSocket.CloseCodes["1000"] > before.WebSocket.CloseCodes["1000"] {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			ws, prev := after.WebSocket, before.WebSocket
+			switch {
+			case ws.CloseCodes["1000"] != prev.CloseCodes["1000"]+1:
+				return fmt.Errorf("close_codes[1000] is %d, want %d", ws.CloseCodes["1000"], prev.CloseCodes["1000"]+1)
+			case ws.TotalConns != prev.TotalConns+1:
+				return fmt.Errorf("total_conns is %d, want %d", ws.TotalConns, prev.TotalConns+1)
+			case ws.OpenConns != prev.OpenConns:
+				return fmt.Errorf("open_conns is %d, want %d", ws.OpenConns, prev.OpenConns)
+			case ws.MessagesIn < prev.MessagesIn+1 || ws.MessagesOut < prev.MessagesOut+1:
+				return fmt.Errorf("messages_in/out are %d/%d, want more than %d/%d",
+					ws.MessagesIn, ws.MessagesOut, prev.MessagesIn, prev.MessagesOut)
+			}
+			return nil
+		}},
+	}
+}
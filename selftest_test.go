@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestSelftest runs the checks of the selftest subcommand against this test binary running as gelbo
+func TestSelftest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping selftest in short mode")
+	}
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := startSelftestServer(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.stop()
+	for _, check := range selftestChecks() {
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.run(env); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
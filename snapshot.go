@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const currentSnapshotName = "current"
+
+var (
+	snapshots             = NewSnapshotStore()
+	snapshotNameRegexp    = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	errInvalidResetTarget = fmt.Errorf("invalid target")
+)
+
+// NodeCounters ... cumulative counters of a node
+type NodeCounters struct {
+	SentBytes     int64 `json:"sent_bytes"`
+	ReceivedBytes int64 `json:"received_bytes"`
+	RequestCount  int64 `json:"request_count"`
+}
+
+// StatsSnapshot ... counters of the node and each ELB node at taken_at
+type StatsSnapshot struct {
+	Name    string                  `json:"name"`
+	TakenAt int64                   `json:"taken_at"`
+	Node    NodeCounters            `json:"node"`
+	ELBs    map[string]NodeCounters `json:"elbs"`
+}
+
+// StatsDiff ... counter deltas between two snapshots
+type StatsDiff struct {
+	From        string                  `json:"from"`
+	To          string                  `json:"to"`
+	FromTakenAt int64                   `json:"from_taken_at"`
+	ToTakenAt   int64                   `json:"to_taken_at"`
+	Node        NodeCounters            `json:"node"`
+	ELBs        map[string]NodeCounters `json:"elbs"`
+}
+
+// SnapshotStore ... named snapshots with exclusive control
+type SnapshotStore struct {
+	*sync.RWMutex
+	m map[string]*StatsSnapshot
+}
+
+// NewSnapshotStore ... create SnapshotStore instance
+func NewSnapshotStore() *SnapshotStore {
+	return &SnapshotStore{&sync.RWMutex{}, make(map[string]*StatsSnapshot)}
+}
+
+func (ss *SnapshotStore) save(snapshot *StatsSnapshot) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.m[snapshot.Name] = snapshot
+}
+
+func (ss *SnapshotStore) get(name string) (*StatsSnapshot, bool) {
+	if name == currentSnapshotName {
+		return takeSnapshot(name), true
+	}
+	ss.RLock()
+	defer ss.RUnlock()
+	snapshot, ok := ss.m[name]
+	return snapshot, ok
+}
+
+func (ss *SnapshotStore) delete(name string) bool {
+	ss.Lock()
+	defer ss.Unlock()
+	_, ok := ss.m[name]
+	delete(ss.m, name)
+	return ok
+}
+
+// list returns the snapshots in the order of taken_at
+func (ss *SnapshotStore) list() []*StatsSnapshot {
+	ss.RLock()
+	defer ss.RUnlock()
+	list := make([]*StatsSnapshot, 0, len(ss.m))
+	for _, snapshot := range ss.m {
+		list = append(list, snapshot)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TakenAt < list[j].TakenAt })
+	return list
+}
+
+func (ni *NodeInfo) getCounters() NodeCounters {
+	ni.RLock()
+	defer ni.RUnlock()
+	return NodeCounters{RequestCount: ni.RequestCount, SentBytes: ni.SentBytes, ReceivedBytes: ni.ReceivedBytes}
+}
+
+func (nc NodeCounters) sub(other NodeCounters) NodeCounters {
+	return NodeCounters{
+		RequestCount:  nc.RequestCount - other.RequestCount,
+		SentBytes:     nc.SentBytes - other.SentBytes,
+		ReceivedBytes: nc.ReceivedBytes - other.ReceivedBytes,
+	}
+}
+
+func takeSnapshot(name string) *StatsSnapshot {
+	snapshot := &StatsSnapshot{Name: name, TakenAt: time.Now().UnixNano(), ELBs: map[string]NodeCounters{}}
+	store.node.RLock()
+	elbs := make(map[string]*NodeInfo, len(store.node.ELBs))
+	for ip, node := range store.node.ELBs {
+		elbs[ip] = node
+	}
+	store.node.RUnlock()
+	snapshot.Node = store.node.getCounters()
+	for ip, node := range elbs {
+		snapshot.ELBs[ip] = node.getCounters()
+	}
+	return snapshot
+}
+
+// diffSnapshots returns to - from. ELB nodes missing in from are counted from zero.
+func diffSnapshots(from, to *StatsSnapshot) *StatsDiff {
+	diff := &StatsDiff{
+		From:        from.Name,
+		To:          to.Name,
+		FromTakenAt: from.TakenAt,
+		ToTakenAt:   to.TakenAt,
+		Node:        to.Node.sub(from.Node),
+		ELBs:        map[string]NodeCounters{},
+	}
+	for ip, counters := range to.ELBs {
+		diff.ELBs[ip] = counters.sub(from.ELBs[ip])
+	}
+	return diff
+}
+
+// resetStats clears the counters of target (all, node or the IP address of an ELB node).
+// all also clears the counters of the remote nodes not passing through ELB.
+func resetStats(target string) error {
+	switch target {
+	case "all":
+		store.node.resetCounters()
+		remoteNodes.RLock()
+		defer remoteNodes.RUnlock()
+		for _, node := range remoteNodes.m {
+			node.resetCounters()
+		}
+	case "node":
+		store.node.resetCounters()
+	default:
+		store.node.RLock()
+		node, ok := store.node.ELBs[target]
+		store.node.RUnlock()
+		if !ok {
+			return errInvalidResetTarget
+		}
+		node.resetCounters()
+	}
+	return nil
+}
+
+// resetHandler serves /monitor/reset?target=all|node|ELB IP and displays the statistics after the reset
+func resetHandler(w http.ResponseWriter, r *http.Request, rawFlag bool) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		target = "all"
+	}
+	if err := resetStats(target); err != nil {
+		http.Error(w, fmt.Sprintf("%v: %s", err, target), http.StatusBadRequest)
+		return
+	}
+	updateNode()
+	if rawFlag {
+		fmt.Fprintf(w, "\n%s\n", getStoreNodeJSON())
+	} else {
+		fmt.Fprintf(w, "\n%s\n", easeReadJSON(getStoreNodeJSON()))
+	}
+}
+
+// snapshotHandler serves /monitor/snapshot?name= to save (or show with ?show, delete with ?delete) a named snapshot
+func snapshotHandler(w http.ResponseWriter, r *http.Request, rawFlag bool) {
+	qsMap := r.URL.Query()
+	name := qsMap.Get("name")
+	if !snapshotNameRegexp.MatchString(name) || name == currentSnapshotName {
+		http.Error(w, fmt.Sprintf("invalid name: %s", name), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case qsMap.Has("delete"):
+		if !snapshots.delete(name) {
+			http.Error(w, fmt.Sprintf("snapshot not found: %s", name), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case qsMap.Has("show"):
+		snapshot, ok := snapshots.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("snapshot not found: %s", name), http.StatusNotFound)
+			return
+		}
+		writeMonitorJSON(w, snapshot, rawFlag)
+	default:
+		snapshot := takeSnapshot(name)
+		snapshots.save(snapshot)
+		writeMonitorJSON(w, snapshot, rawFlag)
+	}
+}
+
+// diffHandler serves /monitor/diff?from=&to= (to defaults to current)
+func diffHandler(w http.ResponseWriter, r *http.Request, rawFlag bool) {
+	qsMap := r.URL.Query()
+	toName := qsMap.Get("to")
+	if toName == "" {
+		toName = currentSnapshotName
+	}
+	from, ok := snapshots.get(qsMap.Get("from"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("snapshot not found: %s", qsMap.Get("from")), http.StatusNotFound)
+		return
+	}
+	to, ok := snapshots.get(toName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("snapshot not found: %s", toName), http.StatusNotFound)
+		return
+	}
+	writeMonitorJSON(w, diffSnapshots(from, to), rawFlag)
+}
+
+func writeMonitorJSON(w http.ResponseWriter, v interface{}, rawFlag bool) {
+	respJSON, _ := jsonMarshalIndent(v)
+	w.Header().Set("Content-Type", "application/json")
+	if rawFlag {
+		fmt.Fprintf(w, "\n%s\n", respJSON)
+	} else {
+		fmt.Fprintf(w, "\n%s\n", easeReadJSON(respJSON))
+	}
+}
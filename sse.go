@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const sseDefaultInterval = 1000
+
+var sseEventRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// SSEParams ... stream parameters of /sse/ (not directives)
+type SSEParams struct {
+	Interval int    // milliseconds between events
+	Count    int    // last event id. 0 = unlimited
+	Event    string // event field. empty = "message" (omitted)
+	Retry    int    // retry field sent at the beginning. 0 = omitted
+}
+
+// SSEData ... data field of each event
+type SSEData struct {
+	ID       int    `json:"id"`
+	Host     string `json:"host"`
+	HostIP   string `json:"hostIp"`
+	SendTime int64  `json:"sendTime"`
+	Data     string `json:"data,omitempty"`
+}
+
+func parseSSEParams(r *http.Request) (*SSEParams, error) {
+	params := &SSEParams{Interval: sseDefaultInterval}
+	qsMap := r.URL.Query()
+	for key, dest := range map[string]*int{"interval": &params.Interval, "count": &params.Count, "retry": &params.Retry} {
+		if value := qsMap.Get(key); value != "" {
+			num, err := strconv.Atoi(value)
+			if err != nil || num < 0 || (key == "interval" && num == 0) {
+				return nil, fmt.Errorf("invalid %s: %s", key, value)
+			}
+			*dest = num
+		}
+	}
+	if event := qsMap.Get("event"); event != "" {
+		if !sseEventRegexp.MatchString(event) {
+			return nil, fmt.Errorf("invalid event: %s", event)
+		}
+		params.Event = event
+	}
+	return params, nil
+}
+
+// sseHandler streams Server-Sent Events. sleep is applied before the response header,
+// size is the data size of each event and disconnect closes the connection after the last event.
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSSEParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		setStatusForLogger(http.StatusBadRequest, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		setStatusForLogger(http.StatusInternalServerError, r)
+		return
+	}
+
+	reqInfo := newRequestInfo(r)
+	inputCmds := reqInfo.validateCommands(r.URL.Query())
+	resultCmds := inputCmds.evaluate()
+	var dataSize int
+	if inputCmds.needsAction() {
+		if arrayContains(inputCmds.actions, "sleep") {
+			sleep, _ := strconv.Atoi(resultCmds.getValue("sleep"))
+			time.Sleep(time.Duration(sleep) * time.Millisecond)
+		}
+		if arrayContains(inputCmds.actions, "size") {
+			dataSize, _ = strconv.Atoi(resultCmds.getValue("size"))
+		}
+	}
+
+	// resume from the next of Last-Event-ID on reconnect
+	lastID, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if params.Count > 0 && lastID >= params.Count {
+		// 204 tells EventSource to stop reconnecting
+		w.WriteHeader(http.StatusNoContent)
+		setStatusForLogger(http.StatusNoContent, r)
+		return
+	}
+
+	reqSize, _ := io.Copy(io.Discard, r.Body)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	for key, value := range headerMap.getAll() {
+		w.Header().Add(key, value)
+	}
+	w.WriteHeader(http.StatusOK)
+	var respSize int64
+	if params.Retry > 0 {
+		n, _ := fmt.Fprintf(w, "retry: %d\n\n", params.Retry)
+		respSize += int64(n)
+	}
+	flusher.Flush()
+
+	sentSize, completed := streamSSEEvents(w, r, params, lastID+1, dataSize)
+	respSize += sentSize
+
+	store.node.reflectRequest(reqSize, respSize)
+	remoteNodes.m[extractIPAddress(r.RemoteAddr)].reflectRequest(reqSize, respSize)
+	setRespSizeForLogger(respSize, r)
+	setStatusForLogger(http.StatusOK, r)
+
+	if completed && inputCmds.needsAction() && arrayContains(inputCmds.actions, "disconnect") {
+		proto, _ := r.Context().Value("proto").(string)
+		disconnect(r.RemoteAddr, proto, resultCmds.getValue("disconnect") == "rst")
+	}
+}
+
+// streamSSEEvents sends events every interval until the count is reached (completed) or the client goes away
+func streamSSEEvents(w http.ResponseWriter, r *http.Request, params *SSEParams, firstID, dataSize int) (int64, bool) {
+	flusher := w.(http.Flusher)
+	randSrc := rand.New(rand.NewSource(time.Now().UnixNano()))
+	t := time.NewTicker(time.Duration(params.Interval) * time.Millisecond)
+	defer t.Stop()
+	var respSize int64
+	for id := firstID; ; id++ {
+		select {
+		case <-r.Context().Done():
+			return respSize, false
+		case <-t.C:
+		}
+		respSize += writeSSEEvent(w, params.Event, id, randSrc, dataSize)
+		flusher.Flush()
+		if params.Count > 0 && id >= params.Count {
+			return respSize, true
+		}
+	}
+}
+
+func writeSSEEvent(w io.Writer, event string, id int, randSrc *rand.Rand, size int) int64 {
+	data := SSEData{
+		ID:       id,
+		Host:     store.host.Name,
+		HostIP:   store.host.IP,
+		SendTime: time.Now().UTC().UnixNano() / int64(time.Millisecond),
+		Data:     string(randBytes(randSrc, size)),
+	}
+	dataJSON, _ := json.Marshal(data)
+	var n int
+	if event != "" {
+		n, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, dataJSON)
+	} else {
+		n, _ = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, dataJSON)
+	}
+	return int64(n)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestTiming ... timing breakdown of a request
+type RequestTiming struct {
+	conntime time.Time     // time the connection was accepted
+	tls      time.Duration // TLS handshake of the connection (0 if not TLS)
+	header   time.Duration // from the connection ready for the request to the request headers read
+	body     time.Duration // reading the request body
+	action   time.Duration // actions delaying the response (sleep)
+	write    time.Duration // writing the response
+}
+
+// newTimingTLSConfig sets the hooks to config recording the TLS handshake duration of each connection
+func newTimingTLSConfig(config *tls.Config) *tls.Config {
+	// GetConfigForClient returns the clone of config, so set NextProtos added by http.Server here
+	config.NextProtos = []string{"h2", "http/1.1"}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hellotime := time.Now()
+		key := connKey(hello.Conn.RemoteAddr().String(), hello.Conn.LocalAddr().String())
+		connConfig := config.Clone()
+		connConfig.GetConfigForClient = nil
+		// VerifyConnection is called at the end of the handshake even without client certificates
+		connConfig.VerifyConnection = func(tls.ConnectionState) error {
+			if cs, ok := csMaps.get(key); ok {
+				cs.setTLSHandshake(hellotime, time.Now())
+			}
+			return nil
+		}
+		return connConfig, nil
+	}
+	return config
+}
+
+func (cs *ConnState) setTLSHandshake(start, end time.Time) {
+	cs.mu.Lock()
+	cs.tls = end.Sub(start)
+	cs.readytime = end
+	cs.mu.Unlock()
+	cs.connEvent("tls").Float64("tlsdur", durationMillis(end.Sub(start))).Msg("")
+}
+
+// setReady records the time the connection became ready for the next request
+func (cs *ConnState) setReady(t time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.readytime = t
+}
+
+// setConnTiming sets the timing of the connection. the time to the headers read is measured only for
+// the first request of HTTP/2 since the streams are multiplexed.
+func (l *HttpLogger) setConnTiming(cs *ConnState, r *http.Request) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	l.timing.conntime = cs.accepttime
+	l.timing.tls = cs.tls
+	if r.ProtoMajor == 1 || l.reuse == 0 {
+		l.timing.header = l.reqtime.Sub(cs.readytime)
+	}
+}
+
+func setActionTimeForLogger(action time.Duration, r *http.Request) {
+	if logger, ok := r.Context().Value("logger").(*HttpLogger); ok {
+		logger.timing.action = action
+	}
+}
+
+func setWriteTimeForLogger(write time.Duration, r *http.Request) {
+	if logger, ok := r.Context().Value("logger").(*HttpLogger); ok {
+		logger.timing.write = write
+	}
+}
+
+// durationMillis returns d in milliseconds with microsecond precision
+func durationMillis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// serverTiming returns the value of Server-Timing header. the connection metrics (tls) are
+// added only to the first request of the connection, header only when measured, and total is the time until now.
+func (l *HttpLogger) serverTiming() string {
+	metrics := []string{}
+	add := func(name string, d time.Duration) {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", name, durationMillis(d)))
+	}
+	if l.reuse == 0 && l.timing.tls > 0 {
+		add("tls", l.timing.tls)
+	}
+	if l.timing.header > 0 {
+		add("header", l.timing.header)
+	}
+	add("body", l.timing.body)
+	add("action", l.timing.action)
+	add("total", time.Since(l.reqtime))
+	return strings.Join(metrics, ", ")
+}
+
+func setServerTimingHeader(w http.ResponseWriter, r *http.Request) {
+	if logger, ok := r.Context().Value("logger").(*HttpLogger); ok {
+		w.Header().Set("Server-Timing", logger.serverTiming())
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	tracerName     = "github.com/miyaz/gelbo"
+	xrayHeader     = "X-Amzn-Trace-Id"
+	otlpTracesPath = "/v1/traces"
+)
+
+var (
+	otlpEndpoint   string
+	otlpService    string
+	traceSample    float64
+	tracer         trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+	tracerProvider *sdktrace.TracerProvider
+	// traceparent (W3C trace-context) takes precedence over X-Amzn-Trace-Id since it is extracted later
+	tracePropagator = propagation.NewCompositeTextMapPropagator(xrayPropagator{}, propagation.TraceContext{})
+)
+
+// initTracing validates -otlpendpoint. the path of OTLP/HTTP traces is added if omitted.
+func initTracing() error {
+	if otlpEndpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(otlpEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid value \"%s\" for flag -otlpendpoint: not http(s) URL", otlpEndpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	otlpEndpoint = u.String()
+	return nil
+}
+
+// startTracing starts exporting the spans to -otlpendpoint. spans are not created if it is not specified.
+func startTracing() error {
+	if otlpEndpoint == "" {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(otlpEndpoint))
+	if err != nil {
+		return err
+	}
+	res := resource.NewWithAttributes("",
+		attribute.String("service.name", otlpService),
+		attribute.String("service.instance.id", instanceID),
+		attribute.String("host.name", store.host.Name),
+		attribute.String("host.ip", store.host.IP),
+	)
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(traceSample))),
+		sdktrace.WithIDGenerator(xrayIDGenerator{}),
+	)
+	tracer = tracerProvider.Tracer(tracerName)
+	return nil
+}
+
+// shutdownTracing exports the spans not exported yet
+func shutdownTracing(timeout time.Duration) {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tracerProvider.Shutdown(ctx)
+}
+
+// === X-Ray trace header (X-Amzn-Trace-Id: Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1)
+
+type xrayRootKey struct{}
+
+// xrayPropagator extracts the trace of X-Amzn-Trace-Id. ALB adds only Root (no Parent) to the header,
+// then the span of gelbo becomes the root span of the trace (see xrayIDGenerator).
+type xrayPropagator struct{}
+
+func (xrayPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	traceID := sc.TraceID().String()
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	carrier.Set(xrayHeader, fmt.Sprintf("Root=1-%s-%s;Parent=%s;Sampled=%s", traceID[:8], traceID[8:], sc.SpanID(), sampled))
+}
+
+func (xrayPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	value := carrier.Get(xrayHeader)
+	if value == "" {
+		return ctx
+	}
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	var hasRoot, hasParent bool
+	flags := trace.FlagsSampled
+	for _, part := range strings.Split(value, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "Root":
+			// 1-{epoch 8 hex}-{24 hex}
+			fields := strings.Split(val, "-")
+			if len(fields) == 3 && fields[0] == "1" {
+				b, err := hex.DecodeString(fields[1] + fields[2])
+				hasRoot = err == nil && len(b) == len(traceID)
+				copy(traceID[:], b)
+			}
+		case "Parent":
+			b, err := hex.DecodeString(val)
+			hasParent = err == nil && len(b) == len(spanID)
+			copy(spanID[:], b)
+		case "Sampled":
+			if val == "0" {
+				flags = 0
+			}
+		}
+	}
+	if !hasRoot || !traceID.IsValid() {
+		return ctx
+	}
+	if !hasParent || !spanID.IsValid() {
+		return context.WithValue(ctx, xrayRootKey{}, traceID)
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: flags, Remote: true,
+	}))
+}
+
+func (xrayPropagator) Fields() []string {
+	return []string{xrayHeader}
+}
+
+// xrayIDGenerator uses the trace ID of X-Amzn-Trace-Id without Parent for the root span
+type xrayIDGenerator struct{}
+
+func (xrayIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, ok := ctx.Value(xrayRootKey{}).(trace.TraceID)
+	if !ok {
+		for !traceID.IsValid() {
+			binary.BigEndian.PutUint64(traceID[:8], rand.Uint64())
+			binary.BigEndian.PutUint64(traceID[8:], rand.Uint64())
+		}
+	}
+	return traceID, newSpanID()
+}
+
+func (xrayIDGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	return newSpanID()
+}
+
+func newSpanID() (spanID trace.SpanID) {
+	for !spanID.IsValid() {
+		binary.BigEndian.PutUint64(spanID[:], rand.Uint64())
+	}
+	return
+}
+
+// metadataCarrier ... propagation.TextMapCarrier of the gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// === spans
+
+// startHTTPSpan starts the span of the request handled by defaultHandler
+func startHTTPSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" /", trace.WithSpanKind(trace.SpanKindServer))
+	if span.IsRecording() {
+		proto, _ := r.Context().Value("proto").(string)
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", "/"),
+			attribute.String("url.path", r.URL.EscapedPath()),
+			attribute.String("url.query", r.URL.RawQuery),
+			attribute.String("server.address", r.Host),
+			attribute.String("client.address", getClientIPAddress(r)),
+			attribute.String("network.peer.address", extractIPAddress(r.RemoteAddr)),
+			attribute.String("network.protocol.version", fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)),
+			attribute.String("user_agent.original", r.UserAgent()),
+			attribute.String("gelbo.proto", proto),
+		)
+	}
+	return ctx, span
+}
+
+// endHTTPSpan ends the span with the response. status 0 means the connection was disconnected by the directive.
+func endHTTPSpan(span trace.Span, status int, size int64) {
+	if status == 0 {
+		span.SetStatus(otelcodes.Error, "disconnected")
+	} else {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", status),
+			attribute.Int64("http.response.body.size", size),
+		)
+		if status >= 500 {
+			span.SetStatus(otelcodes.Error, "")
+		}
+	}
+	span.End()
+}
+
+// setDirectionForSpan adds the directives executed to the span of ctx
+func setDirectionForSpan(ctx context.Context, input, result *Commands) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() || len(input.actions)+len(input.invalids) == 0 {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.StringSlice("gelbo.directive.actions", input.actions),
+		attribute.Bool("gelbo.directive.executed", input.needsAction()),
+	}
+	if len(input.ifMatches) > 0 {
+		attrs = append(attrs, attribute.StringSlice("gelbo.directive.matched", input.ifMatches))
+	}
+	if len(input.ifUnmatches) > 0 {
+		attrs = append(attrs, attribute.StringSlice("gelbo.directive.unmatched", input.ifUnmatches))
+	}
+	if len(input.invalids) > 0 {
+		attrs = append(attrs, attribute.StringSlice("gelbo.directive.invalid", input.invalids))
+	}
+	for _, action := range input.actions {
+		attrs = append(attrs, attribute.String("gelbo.directive."+action, result.getValue(action)))
+	}
+	span.SetAttributes(attrs...)
+	// streams have the directives per message
+	span.AddEvent("directive", trace.WithAttributes(attrs...))
+}
+
+// startGrpcSpan starts the span of the rpc called through the interceptors
+func startGrpcSpan(ctx context.Context, fullMethod, proto string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = tracePropagator.Extract(ctx, metadataCarrier(md))
+	ctx, span := tracer.Start(ctx, strings.TrimPrefix(fullMethod, "/"), trace.WithSpanKind(trace.SpanKindServer))
+	if span.IsRecording() {
+		service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+		span.SetAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+			attribute.String("gelbo.proto", proto),
+		)
+		if cs, ok := getConnStateFromContext(ctx); ok {
+			span.SetAttributes(attribute.String("network.peer.address", extractIPAddress(cs.conn.RemoteAddr().String())))
+		}
+	}
+	return ctx, span
+}
+
+func endGrpcSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+	if code != codes.OK {
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+	span.End()
+}
+
+// startWsSpan starts the span of the WebSocket session (from the upgrade to the close)
+func startWsSpan(r *http.Request) trace.Span {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	_, span := tracer.Start(ctx, "WebSocket /ws/", trace.WithSpanKind(trace.SpanKindServer))
+	if span.IsRecording() {
+		proto, _ := r.Context().Value("proto").(string)
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", "/ws/"),
+			attribute.String("url.path", r.URL.EscapedPath()),
+			attribute.String("client.address", getClientIPAddress(r)),
+			attribute.String("network.peer.address", extractIPAddress(r.RemoteAddr)),
+			attribute.String("gelbo.proto", proto),
+		)
+	}
+	return span
+}
+
+func (c *Client) traceMessage(size int) {
+	if c.span.IsRecording() {
+		c.span.AddEvent("message", trace.WithAttributes(attribute.Int("messaging.message.body.size", size)))
+	}
+}
+
+func (c *Client) traceControl(control string) {
+	if c.span.IsRecording() {
+		c.span.AddEvent("control", trace.WithAttributes(attribute.String("gelbo.ws.control", control)))
+	}
+}
+
+// endSpan ends the span of the session with the close code received ("none" if no close frame)
+func (c *Client) endSpan(code string) {
+	c.span.SetAttributes(attribute.String("gelbo.ws.close_code", code))
+	c.span.End()
+}
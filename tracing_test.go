@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestXrayPropagator(t *testing.T) {
+	const traceID = "5759e988bd862e3fe1be46a994272793"
+	tests := []struct {
+		header  string
+		parent  string // span id of the remote span context. empty if not extracted
+		root    string // trace id kept for the root span
+		sampled bool
+	}{
+		{header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1", parent: "53995c3f42cd8ad8", sampled: true},
+		{header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0", parent: "53995c3f42cd8ad8"},
+		{header: "Root=1-5759e988-bd862e3fe1be46a994272793", root: traceID},
+		{header: "Self=1-5759e988-bd862e3fe1be46a994272793"},
+		{header: "Root=2-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			carrier := propagation.MapCarrier{xrayHeader: tt.header}
+			ctx := xrayPropagator{}.Extract(context.Background(), carrier)
+			sc := trace.SpanContextFromContext(ctx)
+			if tt.parent == "" {
+				if sc.IsValid() {
+					t.Errorf("span context %v is extracted", sc)
+				}
+			} else if sc.TraceID().String() != traceID || sc.SpanID().String() != tt.parent || sc.IsSampled() != tt.sampled {
+				t.Errorf("span context = %s/%s sampled %v", sc.TraceID(), sc.SpanID(), sc.IsSampled())
+			}
+			root, ok := ctx.Value(xrayRootKey{}).(trace.TraceID)
+			if (tt.root != "") != ok || (ok && root.String() != tt.root) {
+				t.Errorf("root trace id = %v (%v), want %q", root, ok, tt.root)
+			}
+			if tt.root != "" {
+				if id, _ := (xrayIDGenerator{}).NewIDs(ctx); id.String() != tt.root {
+					t.Errorf("trace id of the root span = %s, want %s", id, tt.root)
+				}
+			}
+		})
+	}
+}
+
+func TestXrayPropagatorInject(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("5759e988bd862e3fe1be46a994272793")
+	spanID, _ := trace.SpanIDFromHex("53995c3f42cd8ad8")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled,
+	}))
+	carrier := propagation.MapCarrier{}
+	xrayPropagator{}.Inject(ctx, carrier)
+	want := "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+	if got := carrier.Get(xrayHeader); got != want {
+		t.Errorf("%s = %q, want %q", xrayHeader, got, want)
+	}
+}
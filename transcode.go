@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/miyaz/gelbo/grpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// transcodeServer is shared by all transcoded requests. It runs the same
+// gelboServer methods as the grpc/grpcs listeners.
+var transcodeServer = newGelboServer()
+
+var (
+	transcodeUnmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
+	transcodeMarshaler   = protojson.MarshalOptions{UseProtoNames: true}
+)
+
+// grpcTranscodeHandler handles HTTP/JSON requests to /grpc/{service}/{method}.
+// The JSON body is converted to GelboRequest and passed to gelboServer, so the
+// directives behave the same as they do over gRPC.
+//
+//   - Unary / ServerStream: the body is a single JSON GelboRequest (may be empty)
+//   - ClientStream / BidiStream: the body is newline-delimited JSON GelboRequests
+//   - ServerStream / BidiStream responses are NDJSON, or SSE when the client
+//     accepts text/event-stream
+func grpcTranscodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		setStatusForLogger(http.StatusMethodNotAllowed, r)
+		return
+	}
+	fullMethod, ok := getTranscodeFullMethod(r.URL.Path)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		setStatusForLogger(http.StatusNotFound, r)
+		return
+	}
+
+	stream := newTranscodeStream(w, r, fullMethod)
+	var err error
+	switch fullMethod {
+	case pb.GelboService_Unary_FullMethodName:
+		var req *pb.GelboRequest
+		if req, err = stream.recvSingle(); err == nil {
+			var resp *pb.GelboResponse
+			if resp, err = transcodeServer.Unary(stream.ctx, req); err == nil && resp != nil {
+				err = stream.Send(resp)
+			}
+		}
+	case pb.GelboService_ServerStream_FullMethodName:
+		var req *pb.GelboRequest
+		if req, err = stream.recvSingle(); err == nil {
+			stream.streaming = true
+			err = transcodeServer.ServerStream(req, stream)
+		}
+	case pb.GelboService_ClientStream_FullMethodName:
+		err = transcodeServer.ClientStream(stream)
+	case pb.GelboService_BidiStream_FullMethodName:
+		stream.streaming = true
+		err = transcodeServer.BidiStream(stream)
+	default:
+		err = transcodeServer.UnregisteredMethodHandler(nil, stream)
+	}
+	stream.finish(err)
+
+	setRespSizeForLogger(stream.size, r)
+	setStatusForLogger(stream.status, r)
+}
+
+// getTranscodeFullMethod converts "/grpc/{service}/{method}" to a gRPC full
+// method name. The package name "elbgrpc." may be omitted from the service.
+func getTranscodeFullMethod(path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/grpc/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	service := parts[0]
+	if !strings.Contains(service, ".") {
+		service = "elbgrpc." + service
+	}
+	return "/" + service + "/" + parts[1], true
+}
+
+// transcodeTransport implements grpc.ServerTransportStream so that
+// grpc.Method / grpc.SetHeader / grpc.SetTrailer work in gelboServer.handler.
+type transcodeTransport struct {
+	mu         *sync.Mutex
+	method     string
+	header     metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+}
+
+func (t *transcodeTransport) Method() string {
+	return t.method
+}
+
+func (t *transcodeTransport) SetHeader(md metadata.MD) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.headerSent {
+		return errors.New("transport: the header has been sent")
+	}
+	t.header = metadata.Join(t.header, md)
+	return nil
+}
+
+func (t *transcodeTransport) SendHeader(md metadata.MD) error {
+	if err := t.SetHeader(md); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *transcodeTransport) SetTrailer(md metadata.MD) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.trailer = metadata.Join(t.trailer, md)
+	return nil
+}
+
+// transcodeStream implements the server side stream interfaces of
+// GelboService on top of an http.ResponseWriter.
+type transcodeStream struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	w         http.ResponseWriter
+	dec       *json.Decoder
+	transport *transcodeTransport
+	streaming bool
+	sse       bool
+	eventID   int
+	size      int64
+	status    int
+}
+
+func newTranscodeStream(w http.ResponseWriter, r *http.Request, fullMethod string) *transcodeStream {
+	httpProto, _ := r.Context().Value("proto").(string)
+	transport := &transcodeTransport{mu: &sync.Mutex{}, method: fullMethod}
+
+	md := metadata.MD{}
+	for key, values := range r.Header {
+		md.Append(strings.ToLower(key), values...)
+	}
+	md.Set(":authority", r.Host)
+
+	pr := &peer.Peer{Addr: newTranscodeAddr(r.RemoteAddr)}
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		pr.LocalAddr = localAddr
+	} else {
+		pr.LocalAddr = newTranscodeAddr(store.host.IP)
+	}
+
+	// allow reading requests after writing responses on HTTP/1.x (BidiStream)
+	http.NewResponseController(w).EnableFullDuplex()
+
+	ctx := context.WithValue(r.Context(), "transcode", httpProto)
+	ctx = metadata.NewIncomingContext(ctx, md)
+	ctx = peer.NewContext(ctx, pr)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, transport)
+	cancel := context.CancelFunc(func() {})
+	if timeout, ok := parseGrpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	return &transcodeStream{
+		ctx:       ctx,
+		cancel:    cancel,
+		w:         w,
+		dec:       json.NewDecoder(r.Body),
+		transport: transport,
+		sse:       strings.Contains(r.Header.Get("Accept"), "text/event-stream"),
+		status:    http.StatusOK,
+	}
+}
+
+// parseGrpcTimeout parses the value of grpc-timeout header (e.g. "100m", "5S").
+func parseGrpcTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	num, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || num < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(num) * unit, true
+}
+
+func newTranscodeAddr(addr string) net.Addr {
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return tcpAddr
+	}
+	return &net.TCPAddr{IP: net.ParseIP(extractIPAddress(addr)), Port: extractPort(addr)}
+}
+
+// recvSingle reads the whole body as one GelboRequest.
+func (s *transcodeStream) recvSingle() (*pb.GelboRequest, error) {
+	req, err := s.Recv()
+	if errors.Is(err, io.EOF) {
+		return &pb.GelboRequest{}, nil
+	}
+	return req, err
+}
+
+// Recv reads the next JSON GelboRequest from the request body.
+func (s *transcodeStream) Recv() (*pb.GelboRequest, error) {
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req := &pb.GelboRequest{}
+	if err := transcodeUnmarshaler.Unmarshal(raw, req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return req, nil
+}
+
+// Send writes a GelboResponse as JSON (unary), a NDJSON line or a SSE event.
+func (s *transcodeStream) Send(resp *pb.GelboResponse) error {
+	s.writeHeader(http.StatusOK)
+	var body []byte
+	if s.streaming {
+		respJSON, err := transcodeMarshaler.Marshal(resp)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if s.sse {
+			s.eventID++
+			body = fmt.Appendf(nil, "id: %d\nevent: message\ndata: %s\n\n", s.eventID, respJSON)
+		} else {
+			body = append(respJSON, '\n')
+		}
+	} else {
+		respJSON, err := protojson.MarshalOptions{UseProtoNames: true, Multiline: true, Indent: "  "}.Marshal(resp)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		body = append(respJSON, '\n')
+	}
+	n, err := s.w.Write(body)
+	s.size += int64(n)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s *transcodeStream) SendAndClose(resp *pb.GelboResponse) error {
+	return s.Send(resp)
+}
+
+// writeHeader writes the header metadata and the status code once.
+func (s *transcodeStream) writeHeader(statusCode int) {
+	s.transport.mu.Lock()
+	defer s.transport.mu.Unlock()
+	if s.transport.headerSent {
+		return
+	}
+	s.transport.headerSent = true
+	for key, values := range s.transport.header {
+		for _, value := range values {
+			s.w.Header().Add(key, value)
+		}
+	}
+	switch {
+	case s.streaming && s.sse:
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+	case s.streaming:
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		s.w.Header().Set("Content-Type", "application/json")
+	}
+	s.status = statusCode
+	s.w.WriteHeader(statusCode)
+}
+
+// finish reports the result of the rpc. Trailer metadata and grpc-status are
+// sent as HTTP trailers. If nothing has been written yet, the error is written
+// as a JSON body with the HTTP status corresponding to the gRPC code.
+func (s *transcodeStream) finish(err error) {
+	defer s.cancel()
+	stat := status.Convert(err)
+	s.transport.mu.Lock()
+	headerSent := s.transport.headerSent
+	s.transport.mu.Unlock()
+	if !headerSent {
+		s.streaming = false
+		s.writeHeader(httpStatusFromCode(stat.Code()))
+	}
+	if err != nil {
+		errJSON, _ := transcodeMarshaler.Marshal(stat.Proto())
+		var body []byte
+		if s.streaming && s.sse {
+			body = fmt.Appendf(nil, "event: error\ndata: %s\n\n", errJSON)
+		} else if s.streaming {
+			body = fmt.Appendf(nil, "{\"error\":%s}\n", errJSON)
+		} else {
+			body = append(errJSON, '\n')
+		}
+		n, _ := s.w.Write(body)
+		s.size += int64(n)
+	}
+
+	s.transport.mu.Lock()
+	defer s.transport.mu.Unlock()
+	for key, values := range s.transport.trailer {
+		for _, value := range values {
+			s.w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+	s.w.Header().Set(http.TrailerPrefix+"Grpc-Status", fmt.Sprintf("%d", stat.Code()))
+	if stat.Message() != "" {
+		s.w.Header().Set(http.TrailerPrefix+"Grpc-Message", stat.Message())
+	}
+}
+
+func (s *transcodeStream) SetHeader(md metadata.MD) error {
+	return s.transport.SetHeader(md)
+}
+
+func (s *transcodeStream) SendHeader(md metadata.MD) error {
+	if err := s.transport.SendHeader(md); err != nil {
+		return err
+	}
+	s.writeHeader(http.StatusOK)
+	return nil
+}
+
+func (s *transcodeStream) SetTrailer(md metadata.MD) {
+	s.transport.SetTrailer(md)
+}
+
+func (s *transcodeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *transcodeStream) SendMsg(m interface{}) error {
+	resp, ok := m.(*pb.GelboResponse)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	return s.Send(resp)
+}
+
+func (s *transcodeStream) RecvMsg(m interface{}) error {
+	req, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	dst, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	proto.Merge(dst, req)
+	return nil
+}
+
+// httpStatusFromCode maps a gRPC status code to the HTTP status code.
+// (same mapping as grpc-gateway)
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -138,37 +139,47 @@ type ResponseInfo struct {
 
 // Commands ... Commands Values
 type Commands struct {
-	CPU         string `json:"cpu,omitempty"`
-	Memory      string `json:"memory,omitempty"`
-	Sleep       string `json:"sleep,omitempty"`
-	Size        string `json:"size,omitempty"`
-	Code        string `json:"code,omitempty"`
-	Status      string `json:"status,omitempty"`
-	AddHeader   string `json:"addheader,omitempty"`
-	DelHeader   string `json:"delheader,omitempty"`
-	AddTrailer  string `json:"addtrailer,omitempty"`
-	DelTrailer  string `json:"deltrailer,omitempty"`
-	Chunk       string `json:"chunk,omitempty"`
-	Stdout      string `json:"stdout,omitempty"`
-	Stderr      string `json:"stderr,omitempty"`
-	Disconnect  string `json:"disconnect,omitempty"`
-	Repeat      string `json:"repeat,omitempty"`
-	DataOnly    string `json:"dataonly,omitempty"`
-	Noop        string `json:"noop,omitempty"`
-	actions     []string
-	ifMatches   []string
-	ifUnmatches []string
-	invalids    []string
-	IfClientIP  string `json:"ifclientip,omitempty"`
-	IfProxy1IP  string `json:"ifproxy1ip,omitempty"`
-	IfProxy2IP  string `json:"ifproxy2ip,omitempty"`
-	IfProxy3IP  string `json:"ifproxy3ip,omitempty"`
-	IfLasthopIP string `json:"iflasthopip,omitempty"`
-	IfTargetIP  string `json:"iftargetip,omitempty"`
-	IfHostIP    string `json:"ifhostip,omitempty"`
-	IfHost      string `json:"ifhost,omitempty"`
-	IfAZ        string `json:"ifaz,omitempty"`
-	IfType      string `json:"iftype,omitempty"`
+	CPU             string `json:"cpu,omitempty"`
+	Memory          string `json:"memory,omitempty"`
+	Sleep           string `json:"sleep,omitempty"`
+	Size            string `json:"size,omitempty"`
+	Code            string `json:"code,omitempty"`
+	Status          string `json:"status,omitempty"`
+	AddHeader       string `json:"addheader,omitempty"`
+	DelHeader       string `json:"delheader,omitempty"`
+	AddTrailer      string `json:"addtrailer,omitempty"`
+	DelTrailer      string `json:"deltrailer,omitempty"`
+	Chunk           string `json:"chunk,omitempty"`
+	Stdout          string `json:"stdout,omitempty"`
+	Stderr          string `json:"stderr,omitempty"`
+	Disconnect      string `json:"disconnect,omitempty"`
+	Repeat          string `json:"repeat,omitempty"`
+	DataOnly        string `json:"dataonly,omitempty"`
+	Noop            string `json:"noop,omitempty"`
+	GrpcPing        string `json:"grpcping,omitempty"`
+	GrpcPingTimeout string `json:"grpcpingtimeout,omitempty"`
+	GrpcMaxIdle     string `json:"grpcmaxidle,omitempty"`
+	GrpcMaxAge      string `json:"grpcmaxage,omitempty"`
+	GrpcMaxAgeGrace string `json:"grpcmaxagegrace,omitempty"`
+	GrpcMinPingTime string `json:"grpcminpingtime,omitempty"`
+	GrpcMaxStreams  string `json:"grpcmaxstreams,omitempty"`
+	GrpcWindow      string `json:"grpcwindow,omitempty"`
+	GrpcConnWindow  string `json:"grpcconnwindow,omitempty"`
+	IgnoreDeadline  string `json:"ignoredeadline,omitempty"`
+	actions         []string
+	ifMatches       []string
+	ifUnmatches     []string
+	invalids        []string
+	IfClientIP      string `json:"ifclientip,omitempty"`
+	IfProxy1IP      string `json:"ifproxy1ip,omitempty"`
+	IfProxy2IP      string `json:"ifproxy2ip,omitempty"`
+	IfProxy3IP      string `json:"ifproxy3ip,omitempty"`
+	IfLasthopIP     string `json:"iflasthopip,omitempty"`
+	IfTargetIP      string `json:"iftargetip,omitempty"`
+	IfHostIP        string `json:"ifhostip,omitempty"`
+	IfHost          string `json:"ifhost,omitempty"`
+	IfAZ            string `json:"ifaz,omitempty"`
+	IfType          string `json:"iftype,omitempty"`
 }
 
 func (cmds *Commands) getValue(key string) (ret string) {
@@ -207,6 +218,26 @@ func (cmds *Commands) getValue(key string) (ret string) {
 		ret = cmds.DataOnly
 	case "noop":
 		ret = cmds.Noop
+	case "grpcping":
+		ret = cmds.GrpcPing
+	case "grpcpingtimeout":
+		ret = cmds.GrpcPingTimeout
+	case "grpcmaxidle":
+		ret = cmds.GrpcMaxIdle
+	case "grpcmaxage":
+		ret = cmds.GrpcMaxAge
+	case "grpcmaxagegrace":
+		ret = cmds.GrpcMaxAgeGrace
+	case "grpcminpingtime":
+		ret = cmds.GrpcMinPingTime
+	case "grpcmaxstreams":
+		ret = cmds.GrpcMaxStreams
+	case "grpcwindow":
+		ret = cmds.GrpcWindow
+	case "grpcconnwindow":
+		ret = cmds.GrpcConnWindow
+	case "ignoredeadline":
+		ret = cmds.IgnoreDeadline
 	}
 	return
 }
@@ -247,6 +278,26 @@ func (cmds *Commands) setValue(key, value string) {
 		cmds.DataOnly = value
 	case "noop":
 		cmds.Noop = value
+	case "grpcping":
+		cmds.GrpcPing = value
+	case "grpcpingtimeout":
+		cmds.GrpcPingTimeout = value
+	case "grpcmaxidle":
+		cmds.GrpcMaxIdle = value
+	case "grpcmaxage":
+		cmds.GrpcMaxAge = value
+	case "grpcmaxagegrace":
+		cmds.GrpcMaxAgeGrace = value
+	case "grpcminpingtime":
+		cmds.GrpcMinPingTime = value
+	case "grpcmaxstreams":
+		cmds.GrpcMaxStreams = value
+	case "grpcwindow":
+		cmds.GrpcWindow = value
+	case "grpcconnwindow":
+		cmds.GrpcConnWindow = value
+	case "ignoredeadline":
+		cmds.IgnoreDeadline = value
 	case "ifclientip":
 		cmds.IfClientIP = value
 	case "ifproxy1ip":
@@ -274,6 +325,7 @@ func newValidator() (map[string]*regexp.Regexp, map[string]*regexp.Regexp) {
 	const (
 		regexpPercent      = "^(100|[0-9]{1,2})$"
 		regexpNumRange     = "^([0-9]+)(?:-([0-9]+))?$"
+		regexpNum          = "^([0-9]+)$"
 		regexpCode         = "^([0-9]|1[0-6])$"
 		regexpStatus       = "^([1-9][0-9]{2})$"
 		regexpHeader       = "^([a-zA-Z0-9-]+): .+$"
@@ -300,6 +352,15 @@ func newValidator() (map[string]*regexp.Regexp, map[string]*regexp.Regexp) {
 	vh["stdout"] = regexp.MustCompile(regexpAll)
 	vh["stderr"] = regexp.MustCompile(regexpAll)
 	vh["disconnect"] = regexp.MustCompile(regexpDisconnect)
+	vh["grpcping"] = regexp.MustCompile(regexpNum)
+	vh["grpcpingtimeout"] = regexp.MustCompile(regexpNum)
+	vh["grpcmaxidle"] = regexp.MustCompile(regexpNum)
+	vh["grpcmaxage"] = regexp.MustCompile(regexpNum)
+	vh["grpcmaxagegrace"] = regexp.MustCompile(regexpNum)
+	vh["grpcminpingtime"] = regexp.MustCompile(regexpNum)
+	vh["grpcmaxstreams"] = regexp.MustCompile(regexpNum)
+	vh["grpcwindow"] = regexp.MustCompile(regexpNum)
+	vh["grpcconnwindow"] = regexp.MustCompile(regexpNum)
 	vh["ifhost"] = regexp.MustCompile("^(" + regexpHostname + "(" + orSeparator + regexpHostname + ")*)$")
 	vh["ifaz"] = regexp.MustCompile("^(" + regexpAZone + "(" + orSeparator + regexpAZone + ")*)$")
 	vh["iftype"] = regexp.MustCompile("^(" + regexpInstanceType + "(" + orSeparator + regexpInstanceType + ")*)$")
@@ -320,6 +381,7 @@ func newValidator() (map[string]*regexp.Regexp, map[string]*regexp.Regexp) {
 	vg["repeat"] = regexp.MustCompile(regexpNumRange)
 	vg["dataonly"] = regexp.MustCompile(regexpModeOn)
 	vg["noop"] = regexp.MustCompile(regexpModeOn)
+	vg["ignoredeadline"] = regexp.MustCompile(regexpModeOn)
 	delete(vg, "status")
 	delete(vg, "chunk")
 	return vh, vg
@@ -567,6 +629,13 @@ type ConnState struct {
 	reuse     int64
 	prevState http.ConnState
 	curState  http.ConnState
+	// timing of the connection
+	accepttime time.Time
+	readytime  time.Time // accepted, TLS handshake completed or the previous response completed
+	tls        time.Duration
+	proto      string // protocol of the connection (http, https, grpc or grpcs)
+	// first request of grpc connections is logged
+	firstRequest atomic.Bool
 }
 
 func (cs *ConnState) updateState(state http.ConnState) {
@@ -588,14 +657,17 @@ func NewConnStateMap() *ConnStateMap {
 }
 
 func (csm *ConnStateMap) set(k string, v net.Conn) {
+	now := time.Now()
 	csm.Lock()
 	defer csm.Unlock()
 	csm.m[k] = &ConnState{
-		mu:        &sync.RWMutex{},
-		conn:      v,
-		reuse:     -1, // set var[reuse] to -1 as initial value because it will be set to 0 the first time it is used
-		prevState: http.StateNew,
-		curState:  http.StateNew,
+		mu:         &sync.RWMutex{},
+		conn:       v,
+		reuse:      -1, // set var[reuse] to -1 as initial value because it will be set to 0 the first time it is used
+		prevState:  http.StateNew,
+		curState:   http.StateNew,
+		accepttime: now,
+		readytime:  now,
 	}
 }
 func (csm *ConnStateMap) get(k string) (*ConnState, bool) {
@@ -604,6 +676,7 @@ func (csm *ConnStateMap) get(k string) (*ConnState, bool) {
 	v, ok := csm.m[k]
 	return v, ok
 }
+
 // getByRemoteAddr finds a ConnState whose key starts with "remoteAddr->".
 // Used by HTTP handlers that only know r.RemoteAddr and not the local address.
 func (csm *ConnStateMap) getByRemoteAddr(remoteAddr string) (*ConnState, bool) {
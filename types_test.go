@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+
+	pb "github.com/miyaz/gelbo/grpc/pb"
+)
+
+func TestValidateCommands(t *testing.T) {
+	reqInfo := &RequestInfo{Proto: "http", ClientIP: "198.51.100.1", TargetIP: "10.0.0.1"}
+	tests := []struct {
+		query    string
+		actions  []string
+		invalids []string
+		matches  []string
+		needs    bool
+	}{
+		{query: "sleep=100&size=10-20&status=503", actions: []string{"sleep", "size", "status"}, needs: true},
+		{query: "status=99&cpu=101&sleep=abc", invalids: []string{"status", "cpu", "sleep"}},
+		{query: "addheader=X-Test:+on&delheader=X-Test", actions: []string{"addheader", "delheader"}, needs: true},
+		{query: "addheader=X-Test&disconnect=close", invalids: []string{"addheader", "disconnect"}},
+		{query: "code=5&repeat=3", needs: false}, // grpc only
+		{query: "status=202&ifclientip=198.51.100.0/24", actions: []string{"status"}, matches: []string{"ifclientip"}, needs: true},
+		{query: "status=202&iftargetip=192.0.2.1+or+10.0.0.1", actions: []string{"status"}, matches: []string{"iftargetip"}, needs: true},
+		{query: "status=202&ifclientip=192.0.2.1", actions: []string{"status"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			cmds := reqInfo.validateCommands(query)
+			for name, pair := range map[string][2][]string{
+				"actions":   {tt.actions, cmds.actions},
+				"invalids":  {tt.invalids, cmds.invalids},
+				"ifMatches": {tt.matches, cmds.ifMatches},
+			} {
+				want, got := slices.Sorted(slices.Values(pair[0])), slices.Sorted(slices.Values(pair[1]))
+				if !slices.Equal(want, got) {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+			if cmds.needsAction() != tt.needs {
+				t.Errorf("needsAction() = %v, want %v", cmds.needsAction(), tt.needs)
+			}
+		})
+	}
+}
+
+func TestValidateCommandsForGrpc(t *testing.T) {
+	reqInfo := &RequestInfo{Proto: "grpc"}
+	tests := []struct {
+		mode    int
+		repeat  string
+		actions []string
+	}{
+		{Unary, "3", []string{"code"}},
+		{ClientStream, "3", []string{"code"}},
+		{ServerStream, "3", []string{"code", "repeat"}},
+		{BidiStream, "1-3", []string{"code", "repeat"}},
+		{ServerStream, "3-0", []string{"code"}},
+	}
+	for _, tt := range tests {
+		cmds := reqInfo.validateCommandsForGrpc(tt.mode, &pb.GelboRequest{Code: "5", Repeat: tt.repeat})
+		if !slices.Equal(slices.Sorted(slices.Values(cmds.actions)), tt.actions) {
+			t.Errorf("mode %d, repeat=%s: actions = %v, want %v", tt.mode, tt.repeat, cmds.actions, tt.actions)
+		}
+		if len(tt.actions) == 1 && !slices.Contains(cmds.invalids, "repeat") {
+			t.Errorf("mode %d, repeat=%s: invalids = %v, want repeat", tt.mode, tt.repeat, cmds.invalids)
+		}
+	}
+}
+
+func TestGetActionValue(t *testing.T) {
+	cmds := &Commands{Sleep: "300-100", Size: "42"}
+	for range 100 {
+		sleep, _ := strconv.Atoi(cmds.getActionValue("sleep"))
+		if sleep < 100 || sleep > 300 {
+			t.Fatalf("sleep = %d, want 100-300", sleep)
+		}
+	}
+	if size := cmds.getActionValue("size"); size != "42" {
+		t.Errorf("size = %s, want 42", size)
+	}
+}
+
+func TestJudgeActualValue(t *testing.T) {
+	tests := []struct {
+		actual, value string
+		want          bool
+	}{
+		{"198.51.100.1", "198.51.100.1", true},
+		{"198.51.100.1", "198.51.100.2", false},
+		{"198.51.100.1", "198.51.100.0/24", true},
+		{"198.51.100.1", "10.0.0.0/8 or 198.51.100.0/24", true},
+		{"192.0.2.1", "10.0.0.0/8 or 198.51.100.0/24", false},
+		{"2001:db8::1", "2001:db8::/32", true},
+		{"", "198.51.100.0/24", false},
+		{"ip-10-0-0-1", "ip-10-0-0-1 or ip-10-0-0-2", true},
+	}
+	for _, tt := range tests {
+		if got := judgeActualValue(tt.actual, tt.value); got != tt.want {
+			t.Errorf("judgeActualValue(%q, %q) = %v, want %v", tt.actual, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExtractIPAddress(t *testing.T) {
+	tests := []struct {
+		ipport, ip string
+		port       int
+	}{
+		{"198.51.100.1:8080", "198.51.100.1", 8080},
+		{"198.51.100.1", "198.51.100.1", 0},
+		{"[2001:db8::1]:8080", "2001:db8::1", 8080},
+		{"2001:db8::1", "2001:db8::1", 0},
+	}
+	for _, tt := range tests {
+		if ip := extractIPAddress(tt.ipport); ip != tt.ip {
+			t.Errorf("extractIPAddress(%q) = %q, want %q", tt.ipport, ip, tt.ip)
+		}
+		if port := extractPort(tt.ipport); port != tt.port {
+			t.Errorf("extractPort(%q) = %d, want %d", tt.ipport, port, tt.port)
+		}
+	}
+}
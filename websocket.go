@@ -12,21 +12,27 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	hub            *Hub
 	maxMessageSize int64 // Maximum message size allowed from peer.
 	wsInterval     int64
+	wsOrigins      string
+	wsSubprotocols string
 	writeWait      time.Duration
 	pingPeriod     time.Duration
 	pongWait       time.Duration
@@ -35,10 +41,8 @@ var (
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+// buffer sizes, compression, origins and subprotocols are set by flags
+var upgrader = websocket.Upgrader{}
 
 // WsData is struct(json) of WebSocket communication.
 type WsData struct {
@@ -47,6 +51,21 @@ type WsData struct {
 	SendTime  int64  `json:"sendTime,omitempty"`
 	ConnCount int    `json:"connCount,omitempty"`
 	User      User   `json:"user,omitempty"`
+
+	// negotiated values (yourInfo only)
+	Subprotocol string `json:"subprotocol,omitempty"`
+	Extensions  string `json:"extensions,omitempty"`
+
+	// test-control fields (see wscontrol.go)
+	Interval int64  `json:"interval,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	Seq      int    `json:"seq,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Binary   bool   `json:"binary,omitempty"`
+	Code     int    `json:"code,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Mode     string `json:"mode,omitempty"`
 }
 
 // User is part of UserList
@@ -63,15 +82,39 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
+	// Buffered channel of outbound messages. The hub closes it only on unregister,
+	// after readPump has stopped the ticker, so that nothing sends to it anymore.
 	send chan []byte
 
+	// Closed by the hub when it drops the client because the send buffer is full.
+	dropped chan struct{}
+
+	// Outbound frames other than text messages (binary, close).
+	frames chan wsFrame
+
 	// client identifier
 	id    string
 	color string
 
 	// closed flag
 	closed bool
+
+	// negotiated permessage-deflate extension
+	extensions string
+
+	// used by the disconnect control
+	remoteAddr string
+	proto      string
+
+	// statistics of this node and the remote node (shown in /monitor/)
+	stats []*WebSocketStats
+
+	// span of the session (-otlpendpoint)
+	span trace.Span
+
+	// periodic sending started by the startTicker control
+	tickerStop chan struct{}
+	tickerDone chan struct{}
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients.
@@ -87,6 +130,12 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Messages from other gelbo instances (delivered only to the clients of this instance).
+	remote chan []byte
+
+	// Messages to be published to other gelbo instances by the broadcast backend.
+	publish chan []byte
 }
 
 func newHub() *Hub {
@@ -94,6 +143,7 @@ func newHub() *Hub {
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		remote:     make(chan []byte),
 		clients:    make(map[*Client]bool),
 	}
 }
@@ -109,15 +159,27 @@ func (h *Hub) run() {
 				close(client.send)
 			}
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				if !client.closed {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-						delete(h.clients, client)
-					}
-				}
+			h.deliver(message)
+			select {
+			case h.publish <- message:
+			default:
+				// the backend is too slow. the message reaches only local clients
+			}
+		case message := <-h.remote:
+			h.deliver(message)
+		}
+	}
+}
+
+func (h *Hub) deliver(message []byte) {
+	for client := range h.clients {
+		if !client.closed {
+			select {
+			case client.send <- message:
+			default:
+				// send is left open since readPump or the ticker may still send to it
+				close(client.dropped)
+				delete(h.clients, client)
 			}
 		}
 	}
@@ -125,18 +187,25 @@ func (h *Hub) run() {
 
 // wsHandler handles websocket requests from the peer.
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	reqtime := time.Now()
 	logger := wsLogger(r)
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Log().Str("error", fmt.Sprintf("upgrader.Upgrade error: %v", err)).Msg("")
 		return
 	}
+	recordWsUpgrade(r, reqtime)
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), id: getClientID(r, conn), color: getRandomColor()}
+	proto, _ := r.Context().Value("proto").(string)
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), dropped: make(chan struct{}), frames: make(chan wsFrame, 16),
+		id: getClientID(r, conn), color: getRandomColor(), extensions: negotiatedExtensions(r), remoteAddr: r.RemoteAddr, proto: proto}
+	client.initStats(r)
+	client.span = startWsSpan(r)
 	client.hub.register <- client
 
-	logger.Log().Str("color", client.color).Msg("connected")
+	logger.Log().Str("color", client.color).
+		Str("subprotocol", conn.Subprotocol()).
+		Str("extensions", client.extensions).Msg("connected")
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -144,6 +213,86 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	go client.readPump(logger)
 }
 
+func (c *Client) initStats(r *http.Request) {
+	c.stats = []*WebSocketStats{store.node.getWebSocketStats()}
+	remoteIP := extractIPAddress(r.RemoteAddr)
+	remoteNodes.RLock()
+	remoteNode, ok := remoteNodes.m[remoteIP]
+	remoteNodes.RUnlock()
+	if ok {
+		c.stats = append(c.stats, remoteNode.getWebSocketStats())
+		if r.Header.Get("X-Forwarded-For") != "" {
+			// use elb
+			store.node.Lock()
+			store.node.ELBs[remoteIP] = remoteNode
+			store.node.Unlock()
+		}
+	}
+	c.reflectStats(func(ws *WebSocketStats) { ws.reflectOpen() })
+}
+
+func (c *Client) reflectStats(fn func(ws *WebSocketStats)) {
+	for _, ws := range c.stats {
+		fn(ws)
+	}
+}
+
+// closeCode returns the close code received from the peer, or "none" if the connection ended without a close frame
+func closeCode(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+		return strconv.Itoa(closeErr.Code)
+	}
+	return "none"
+}
+
+// checkOrigin allows the origins specified by -wsorigins (all origins if not specified).
+// Requests without Origin header (non-browser clients) are always allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if wsOrigins == "" || origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range splitAndTrim(wsOrigins) {
+		// either full origin (scheme://host[:port]) or host[:port] can be specified
+		if allowed == "*" || strings.EqualFold(allowed, origin) || strings.EqualFold(allowed, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiatedExtensions returns the extensions in the response of upgrader.Upgrade.
+// gorilla/websocket only supports permessage-deflate without context takeover.
+func negotiatedExtensions(r *http.Request) string {
+	if !upgrader.EnableCompression {
+		return ""
+	}
+	for _, value := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+			}
+		}
+	}
+	return ""
+}
+
+func splitAndTrim(s string) []string {
+	values := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 func getClientID(r *http.Request, conn *websocket.Conn) (clientID string) {
 	clientID = fmt.Sprintf("%s, %s", r.RemoteAddr, conn.LocalAddr())
 	if r.Header.Get("X-Forwarded-For") != "" {
@@ -202,17 +351,29 @@ func diffSlice[T comparable](slice1, slice2 []T) []T {
 // reads from this goroutine.
 func (c *Client) readPump(logger *zerolog.Logger) {
 	defer func() {
+		c.stopTicker()
 		c.hub.unregister <- c
 		c.conn.Close()
+		// hijacked connections never reach StateClosed
+		csMaps.del(connKey(c.remoteAddr, c.conn.LocalAddr().String()))
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(appData string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		// the ping payload is the sent time in unix nano
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			c.reflectStats(func(ws *WebSocketStats) { ws.reflectPong(time.Since(time.Unix(0, sent))) })
+		}
+		return nil
+	})
 	var wsInData WsData
 	var wsOutData WsData
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
+			c.reflectStats(func(ws *WebSocketStats) { ws.reflectClose(closeCode(err)) })
+			c.endSpan(closeCode(err))
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Log().Time("closetime", time.Now()).
 					Str("error", fmt.Sprintf("UnexpectedCloseError: %v", err)).Msg("")
@@ -226,6 +387,7 @@ func (c *Client) readPump(logger *zerolog.Logger) {
 			wsOutData.SendTime = time.Now().UTC().UnixNano() / int64(time.Millisecond)
 			wsOutData.ConnCount = len(c.hub.clients) - 1
 			wsOutData.User.ClientID = c.id
+			wsOutData.User.HostIP = store.host.IP
 			wsOutData.User.Color = c.color
 
 			message = convertWsData2JSON(wsOutData)
@@ -233,11 +395,14 @@ func (c *Client) readPump(logger *zerolog.Logger) {
 			c.hub.broadcast <- message
 			break
 		} else {
+			c.reflectStats(func(ws *WebSocketStats) { ws.reflectRead(len(message)) })
+			c.traceMessage(len(message))
 			logger.Log().Time("readtime", time.Now()).Int("msgsize", len(string(message))).Msg("")
 		}
 
+		wsInData = WsData{}
 		if err := json.Unmarshal(message, &wsInData); err != nil {
-			c.send <- message
+			c.queue(message)
 		} else {
 			if wsInData.Type == "whoAmI" {
 				// reply connection info to the user
@@ -245,8 +410,11 @@ func (c *Client) readPump(logger *zerolog.Logger) {
 				wsOutData.User.ClientID = c.id
 				wsOutData.User.HostIP = store.host.IP
 				wsOutData.User.Color = c.color
+				wsOutData.Subprotocol = c.conn.Subprotocol()
+				wsOutData.Extensions = c.extensions
 				message = convertWsData2JSON(wsOutData)
-				c.send <- message
+				c.queue(message)
+				wsOutData.Subprotocol, wsOutData.Extensions = "", ""
 
 				// send connection opened message to all users
 				wsOutData.Type = "deliverMessage"
@@ -257,11 +425,14 @@ func (c *Client) readPump(logger *zerolog.Logger) {
 				wsOutData.User.Color = c.color
 				message = convertWsData2JSON(wsOutData)
 				c.hub.broadcast <- message
+			} else if slices.Contains(wsControlTypes, wsInData.Type) {
+				c.handleControl(wsInData, logger)
 			} else {
 				wsOutData.Message = wsInData.Message
 				wsOutData.SendTime = time.Now().UTC().UnixNano() / int64(time.Millisecond)
 				wsOutData.ConnCount = len(c.hub.clients)
 				wsOutData.User.ClientID = c.id
+				wsOutData.User.HostIP = store.host.IP
 				wsOutData.User.Color = c.color
 				if wsInData.Type == "postToChat" {
 					// send chat message to all users
@@ -272,13 +443,21 @@ func (c *Client) readPump(logger *zerolog.Logger) {
 					// send echo message to the user
 					wsOutData.Type = "echoReply"
 					message = convertWsData2JSON(wsOutData)
-					c.send <- message
+					c.queue(message)
 				}
 			}
 		}
 	}
 }
 
+// queue passes the message to writePump unless the hub has dropped the client.
+func (c *Client) queue(message []byte) {
+	select {
+	case c.send <- message:
+	case <-c.dropped:
+	}
+}
+
 func convertWsData2JSON(wsData WsData) []byte {
 	wsDataJSON, _ := json.Marshal(wsData)
 	respJSON := bytes.TrimSpace(bytes.Replace(wsDataJSON, newline, space, -1))
@@ -316,12 +495,15 @@ func (c *Client) writePump(logger *zerolog.Logger) {
 				return
 			}
 			w.Write(message)
+			size := len(message)
 
 			// Add queued chat messages to the current websocket message.
 			n := len(c.send)
 			for i := 0; i < n; i++ {
+				queued := <-c.send
 				w.Write(newline)
-				w.Write(<-c.send)
+				w.Write(queued)
+				size += len(newline) + len(queued)
 			}
 
 			if err := w.Close(); err != nil {
@@ -332,11 +514,35 @@ func (c *Client) writePump(logger *zerolog.Logger) {
 				c.hub.broadcast <- []byte(fmt.Sprintf("Disconnected due to [%v] in NextWriter.Close", err))
 				return
 			}
+			c.reflectStats(func(ws *WebSocketStats) { ws.reflectWrite(size) })
 			logger.Log().Time("writetime", time.Now()).Int("msgsize", len(string(message))).Msg("")
 
+		case <-c.dropped:
+			// The hub dropped the client.
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+
+		case frame := <-c.frames:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				logger.Log().Time("closetime", time.Now()).
+					Str("error", fmt.Sprintf("c.conn.WriteMessage error: %v", err)).Msg("")
+				c.closed = true
+				return
+			}
+			logger.Log().Time("writetime", time.Now()).Int("msgsize", len(frame.data)).Msg("")
+			if frame.messageType != websocket.CloseMessage {
+				c.reflectStats(func(ws *WebSocketStats) { ws.reflectWrite(len(frame.data)) })
+			} else {
+				// wait for the close frame from the client (readPump ends), then close the connection
+				time.AfterFunc(writeWait, func() { c.conn.Close() })
+			}
+
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			sent := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+			if err := c.conn.WriteMessage(websocket.PingMessage, sent); err != nil {
 				logger.Log().Time("closetime", time.Now()).
 					Str("error", fmt.Sprintf("c.conn.WriteMessage error: %v", err)).Msg("")
 				// notification connection closed
@@ -344,6 +550,7 @@ func (c *Client) writePump(logger *zerolog.Logger) {
 				c.hub.broadcast <- []byte(fmt.Sprintf("Disconnected due to [%v] in WriteMessage", err))
 				return
 			}
+			c.reflectStats(func(ws *WebSocketStats) { ws.reflectPing() })
 			//logger.Log().Time("pingtime", time.Now()).Msg("")
 
 		}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+const (
+	wsBroadcastPath     = "/ws/broadcast"
+	wsRedisChannel      = "gelbo:ws:broadcast"
+	wsPublishQueueSize  = 256
+	wsPeerPostTimeout   = 2 * time.Second
+	wsMaxEnvelopeLength = 1024 * 1024
+)
+
+var (
+	wsBackendName string
+	wsPeers       string
+	wsRedisAddr   string
+	wsBackendLog  = zerolog.New(logOutput)
+)
+
+// BroadcastBackend fans out the messages broadcast by the hub to the hubs of other gelbo instances.
+type BroadcastBackend interface {
+	// Start begins to receive messages published by other instances and passes them to deliver.
+	Start(deliver func(message []byte)) error
+	// Publish sends the message to other instances.
+	Publish(env *wsEnvelope) error
+}
+
+// wsEnvelope is the unit exchanged between instances
+type wsEnvelope struct {
+	Origin  string          `json:"origin"` // instance id, to ignore own messages
+	HostIP  string          `json:"hostIp"`
+	Message json.RawMessage `json:"message"`
+}
+
+func newBroadcastBackend(name string) (BroadcastBackend, error) {
+	switch name {
+	case "local":
+		return &localBackend{}, nil
+	case "peer":
+		return newPeerBackend(splitAndTrim(wsPeers)), nil
+	case "redis":
+		return newRedisBackend(wsRedisAddr)
+	}
+	return nil, fmt.Errorf("unknown websocket broadcast backend: %s", name)
+}
+
+// startBroadcastBackend starts the backend and the goroutine publishing the messages queued by the hub.
+func startBroadcastBackend(h *Hub) {
+	backend, err := newBroadcastBackend(wsBackendName)
+	if err == nil {
+		err = backend.Start(func(message []byte) { h.remote <- message })
+	}
+	if err != nil {
+		wsBackendLog.Log().Str("backend", wsBackendName).Str("error", err.Error()).
+			Msg("failed to start websocket broadcast backend. fall back to local")
+		backend = &localBackend{}
+	}
+	h.publish = make(chan []byte, wsPublishQueueSize)
+	go func() {
+		for message := range h.publish {
+			if !json.Valid(message) {
+				continue // plain text notifications are delivered only to local clients
+			}
+			env := &wsEnvelope{Origin: instanceID, HostIP: store.host.IP, Message: message}
+			if err := backend.Publish(env); err != nil {
+				wsBackendLog.Log().Str("backend", wsBackendName).Str("error", err.Error()).Msg("publish failed")
+			}
+		}
+	}()
+}
+
+// unwrapEnvelope returns the message of other instances (nil for own messages or invalid data)
+func unwrapEnvelope(data []byte) []byte {
+	var env wsEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Origin == instanceID {
+		return nil
+	}
+	return env.Message
+}
+
+// localBackend delivers messages only to the clients of this instance (default)
+type localBackend struct{}
+
+func (b *localBackend) Start(deliver func(message []byte)) error { return nil }
+func (b *localBackend) Publish(env *wsEnvelope) error            { return nil }
+
+// peerBackend posts messages to the other instances over HTTP (full mesh: every instance lists the others in -wspeers).
+type peerBackend struct {
+	peers  []string
+	client *http.Client
+}
+
+func newPeerBackend(peers []string) *peerBackend {
+	for i, peer := range peers {
+		if !strings.Contains(peer, "://") {
+			peer = "http://" + peer
+		}
+		peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	return &peerBackend{peers: peers, client: &http.Client{Timeout: wsPeerPostTimeout}}
+}
+
+func (b *peerBackend) Start(deliver func(message []byte)) error {
+	if len(b.peers) == 0 {
+		return fmt.Errorf("no peers specified by -wspeers")
+	}
+	peerDeliver = deliver
+	return nil
+}
+
+func (b *peerBackend) Publish(env *wsEnvelope) error {
+	body, _ := json.Marshal(env)
+	errs := make(chan error, len(b.peers))
+	for _, peer := range b.peers {
+		go func(peer string) {
+			resp, err := b.client.Post(peer+wsBroadcastPath, "application/json", bytes.NewReader(body))
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusNoContent {
+					err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+				}
+			}
+			if err != nil {
+				err = fmt.Errorf("%s: %w", peer, err)
+			}
+			errs <- err
+		}(peer)
+	}
+	var failed []string
+	for range b.peers {
+		if err := <-errs; err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+var peerDeliver func(message []byte)
+
+// wsBroadcastHandler receives messages posted by the peerBackend of other instances
+func wsBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if peerDeliver == nil {
+		http.Error(w, "peer backend is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, wsMaxEnvelopeLength))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if message := unwrapEnvelope(data); message != nil {
+		peerDeliver(message)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redisBackend uses Redis Pub/Sub. -wsredis accepts host:port or redis[s]:// URL.
+type redisBackend struct {
+	client *redis.Client
+}
+
+func newRedisBackend(addr string) (*redisBackend, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("redis address is not specified by -wsredis")
+	}
+	opts := &redis.Options{Addr: addr}
+	if strings.Contains(addr, "://") {
+		var err error
+		if opts, err = redis.ParseURL(addr); err != nil {
+			return nil, err
+		}
+	}
+	return &redisBackend{client: redis.NewClient(opts)}, nil
+}
+
+func (b *redisBackend) Start(deliver func(message []byte)) error {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, wsRedisChannel)
+	// wait for the confirmation to report connection errors at startup
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+	go func() {
+		// the channel is kept across reconnections by go-redis
+		for msg := range pubsub.Channel() {
+			if message := unwrapEnvelope([]byte(msg.Payload)); message != nil {
+				deliver(message)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *redisBackend) Publish(env *wsEnvelope) error {
+	body, _ := json.Marshal(env)
+	ctx, cancel := context.WithTimeout(context.Background(), wsPeerPostTimeout)
+	defer cancel()
+	return b.client.Publish(ctx, wsRedisChannel, body).Err()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+const (
+	wsDefaultTickInterval = 1000
+	wsMaxFrameSize        = 64 * 1024 * 1024
+)
+
+// wsFrame is a frame written by writePump other than the text messages from the hub (binary, close)
+type wsFrame struct {
+	messageType int
+	data        []byte
+}
+
+var wsControlTypes = []string{"startTicker", "stopTicker", "sendLarge", "sendClose", "ignorePing", "stopReading", "disconnect"}
+
+// handleControl processes test-control messages. It is called only from readPump.
+func (c *Client) handleControl(in WsData, logger *zerolog.Logger) {
+	logger.Log().Str("control", in.Type).Time("readtime", time.Now()).Msg("")
+	c.traceControl(in.Type)
+	var reply string
+	switch in.Type {
+	case "startTicker":
+		interval := in.Interval
+		if interval <= 0 {
+			interval = wsDefaultTickInterval
+		}
+		if in.Size < 0 || in.Size > wsMaxFrameSize {
+			reply = fmt.Sprintf("invalid size: %d", in.Size)
+			break
+		}
+		c.startTicker(time.Duration(interval)*time.Millisecond, in.Count, in.Size)
+		reply = fmt.Sprintf("ticker started (interval=%dms, count=%d, size=%d)", interval, in.Count, in.Size)
+	case "stopTicker":
+		c.stopTicker()
+		reply = "ticker stopped"
+	case "sendLarge":
+		if in.Size <= 0 || in.Size > wsMaxFrameSize {
+			reply = fmt.Sprintf("invalid size: %d", in.Size)
+			break
+		}
+		frame := wsFrame{messageType: websocket.TextMessage}
+		if in.Binary {
+			frame.messageType = websocket.BinaryMessage
+			frame.data = make([]byte, in.Size)
+			rand.Read(frame.data)
+		} else {
+			frame.data = randBytes(mrand.New(mrand.NewSource(time.Now().UnixNano())), in.Size)
+		}
+		c.sendFrame(frame)
+		return
+	case "sendClose":
+		code := in.Code
+		if code == 0 {
+			code = websocket.CloseNormalClosure
+		}
+		c.sendFrame(wsFrame{messageType: websocket.CloseMessage, data: websocket.FormatCloseMessage(code, in.Reason)})
+		return
+	case "ignorePing":
+		if in.Mode == "off" {
+			c.conn.SetPingHandler(nil) // default handler replies pong
+			reply = "answering pings"
+		} else {
+			c.conn.SetPingHandler(func(string) error { return nil })
+			reply = "ignoring pings"
+		}
+	case "stopReading":
+		// the reply is sent before blocking so that the client knows when reading stops
+		duration := time.Duration(in.Duration) * time.Millisecond
+		if duration <= 0 {
+			duration = pongWait
+		}
+		c.sendReply(fmt.Sprintf("stop reading for %v", duration))
+		time.Sleep(duration)
+		// pongs were not read while sleeping
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		reply = "resumed reading"
+	case "disconnect":
+		disconnect(c.remoteAddr, c.proto, in.Mode == "rst")
+		return
+	}
+	c.sendReply(reply)
+}
+
+func (c *Client) sendReply(message string) {
+	wsOutData := WsData{
+		Type:     "controlReply",
+		Message:  message,
+		SendTime: time.Now().UTC().UnixNano() / int64(time.Millisecond),
+	}
+	c.queue(convertWsData2JSON(wsOutData))
+}
+
+// sendFrame passes the frame to writePump. It gives up if writePump has already exited.
+func (c *Client) sendFrame(frame wsFrame) {
+	select {
+	case c.frames <- frame:
+	case <-time.After(writeWait):
+	}
+}
+
+// startTicker sends tick messages every interval until stopped, count messages are sent (0 = unlimited)
+// or the connection is closed.
+func (c *Client) startTicker(interval time.Duration, count, size int) {
+	c.stopTicker()
+	stop, done := make(chan struct{}), make(chan struct{})
+	c.tickerStop, c.tickerDone = stop, done
+	go func() {
+		defer close(done)
+		randSrc := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for seq := 1; count == 0 || seq <= count; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			wsOutData := WsData{
+				Type:     "tick",
+				Message:  string(randBytes(randSrc, size)),
+				SendTime: time.Now().UTC().UnixNano() / int64(time.Millisecond),
+				Seq:      seq,
+			}
+			select {
+			case c.send <- convertWsData2JSON(wsOutData):
+			case <-stop:
+				return
+			case <-c.dropped:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Client) stopTicker() {
+	if c.tickerStop != nil {
+		close(c.tickerStop)
+		<-c.tickerDone
+		c.tickerStop, c.tickerDone = nil, nil
+	}
+}